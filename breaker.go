@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+// errCircuitOpen is returned for requests to a remote host whose circuit breaker is open.
+var errCircuitOpen = errors.New("circuit open")
+
+// RemoteError is a failure to reach the remote host of a repository.
+type RemoteError struct {
+	Host string
+	Err  error
+}
+
+// Error returns the message of the underlying error.
+func (e *RemoteError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *RemoteError) Unwrap() error {
+	return e.Err
+}
+
+// hostBreakers keeps a circuit breaker per remote host, so a host that is down never stops requests to others.
+type hostBreakers struct {
+	mu       sync.Mutex
+	breakers map[string]*gobreaker.CircuitBreaker
+}
+
+// breakers holds the circuit breakers of the run.
+var breakers = &hostBreakers{breakers: map[string]*gobreaker.CircuitBreaker{}}
+
+// get returns the circuit breaker of the host, creating it on first use.
+func (b *hostBreakers) get(host string) *gobreaker.CircuitBreaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cb, ok := b.breakers[host]; ok {
+		return cb
+	}
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        host,
+		MaxRequests: MaxAttempts,
+		Interval:    time.Minute,
+		Timeout:     time.Minute,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures > 3
+		},
+		IsSuccessful: func(err error) bool {
+			return !isHostFailure(err)
+		},
+	})
+	b.breakers[host] = cb
+	return cb
+}
+
+// execute runs fn through the circuit breaker of the host.
+func (b *hostBreakers) execute(host string, fn func() error) error {
+	_, err := b.get(host).Execute(func() (any, error) {
+		return nil, fn()
+	})
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		return fmt.Errorf("%w for host %s", errCircuitOpen, host)
+	}
+	return err
+}
+
+// isHostFailure tells whether an error says something about the health of the remote host. Permanent errors,
+// e.g. a missing repository or bad credentials, belong to a single repository and an interrupted run says
+// nothing about the host, so only transient failures count towards opening the circuit.
+func isHostFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var gitErr *GitError
+	if errors.As(err, &gitErr) {
+		return classifyGitError(gitErr.Stderr) == classTransient
+	}
+	return true
+}
+
+// remoteHost returns the host of a remote url, e.g. github.com for both https://github.com/user/repo.git
+// and git@github.com:user/repo.git. Remotes on the local file system share the host "local".
+func remoteHost(remoteURL string) string {
+	if strings.Contains(remoteURL, "://") {
+		u, err := url.Parse(remoteURL)
+		if err != nil || u.Hostname() == "" {
+			return "local"
+		}
+		return u.Hostname()
+	}
+	// The scp-like syntax [user@]host:path is used when there is a colon before the first slash.
+	colon := strings.Index(remoteURL, ":")
+	if colon < 0 || strings.Contains(remoteURL[:colon], "/") {
+		return "local"
+	}
+	host := remoteURL[:colon]
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		host = host[at+1:]
+	}
+	return host
+}
+
+// HostSummary counts the repositories that failed to reach a remote host.
+type HostSummary struct {
+	Host        string `json:"host"`
+	Failed      int    `json:"failed"`
+	CircuitOpen int    `json:"circuit_open"`
+}
+
+// summarizeHosts returns the remote hosts that could not be reached, sorted by host. Repositories that were
+// not tried because the circuit of their host was open are counted separately from the ones that failed.
+func summarizeHosts(results []CheckResult) []HostSummary {
+	byHost := map[string]*HostSummary{}
+	for _, result := range results {
+		var remoteErr *RemoteError
+		if !errors.As(result.Err, &remoteErr) {
+			continue
+		}
+		summary, ok := byHost[remoteErr.Host]
+		if !ok {
+			summary = &HostSummary{Host: remoteErr.Host}
+			byHost[remoteErr.Host] = summary
+		}
+		if errors.Is(remoteErr, errCircuitOpen) {
+			summary.CircuitOpen++
+		} else {
+			summary.Failed++
+		}
+	}
+
+	summaries := make([]HostSummary, 0, len(byHost))
+	for _, summary := range byHost {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Host < summaries[j].Host
+	})
+	return summaries
+}
@@ -1,144 +1,389 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"sync"
 )
 
+// checkRepositories checks the repositories with a bounded pool of workers and collects the results.
+// The pool limits how many git processes, and thus connections to the remote hosts, run at once.
+func checkRepositories(ctx context.Context, repos []string, cfg Config) []CheckResult {
+	var wg sync.WaitGroup
+	dirs := make(chan string)
+	results := make(chan CheckResult, len(repos))
+
+	workers := min(max(cfg.Jobs, 1), max(len(repos), 1))
+	for i := 0; i < workers; i++ {
+		go func() {
+			for dir := range dirs {
+				checkIfBehind(ctx, dir, &wg, results, cfg)
+			}
+		}()
+	}
+
+	wg.Add(len(repos))
+	for _, dir := range repos {
+		dirs <- dir
+	}
+	close(dirs)
+
+	wg.Wait()
+	close(results)
+
+	checked := make([]CheckResult, 0, len(repos))
+	for result := range results {
+		checked = append(checked, result)
+	}
+	return checked
+}
+
+// runConcurrently calls fn for every index below n, running at most jobs calls at once.
+func runConcurrently(n, jobs int, fn func(i int)) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max(jobs, 1))
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
 // checkIfBehind checks if the local branch is behind the remote branch.
-func checkIfBehind(dir string, wg *sync.WaitGroup, results chan<- string, cfg Config) bool {
+// When ctx is cancelled part way through an update, local changes stashed by the update are restored.
+func checkIfBehind(ctx context.Context, dir string, wg *sync.WaitGroup, results chan<- CheckResult, cfg Config) bool {
 	defer wg.Done()
 
+	var g *GitExecutor
+	result := CheckResult{
+		RepoName: filepath.Base(dir),
+		Path:     dir,
+		Remote:   cfg.RemoteName,
+		Branch:   cfg.Branch,
+		DryRun:   cfg.DryRun,
+	}
+
+	// stash and original track the commit of stashed changes and the branch to restore if the update stops
+	// part way.
 	var (
-		params []any
-		err    error
+		stash    string
+		original string
 	)
 
+	// fail reports the repository as failed with the given error, restoring any stashed changes.
+	fail := func(err error) bool {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w (%v)", err, ctx.Err())
+		}
+		if stash != "" {
+			result.Actions = append(result.Actions, restoreStash(ctx, g, original, stash)...)
+		}
+		result.State = StateError
+		result.Err = err
+		results <- result
+		return false
+	}
+
+	// skip reports the repository as skipped for the given reason.
+	skip := func(err error) bool {
+		result.State = StateSkipped
+		result.Err = err
+		results <- result
+		return false
+	}
+
+	// Don't start on repositories once the run is interrupted or timed out.
+	if ctx.Err() != nil {
+		return skip(fmt.Errorf("Skipped %s: %v", result.RepoName, ctx.Err()))
+	}
+
 	// Find root directory of repository.
-	gitRoot, err := getGitRoot(dir)
+	gitRoot, err := getGitRoot(ctx, cfg.gitRunner(), dir)
 	if err != nil {
-		results <- fmt.Sprintf("%sError getting Git root for %s: %v%s", LightRed, dir, err, Reset)
-		return false
+		return fail(fmt.Errorf("Error getting Git root for %s: %w", dir, err))
 	}
 
-	g := NewGitExecutor(cfg, gitRoot, filepath.Base(gitRoot))
+	// Apply the overrides configured for this repository.
+	cfg = cfg.forRepo(gitRoot)
+	result.Remote = cfg.RemoteName
+	result.Branch = cfg.Branch
 
-	// Check if the remote exists.
-	if !g.hasRemoteURL() {
-		results <- fmt.Sprintf("%sNo remote named '%s' found for %s%s", LightRed, g.RemoteName, g.RepoName, Reset)
-		return false
+	g = NewGitExecutor(cfg, gitRoot, filepath.Base(gitRoot))
+	result.RepoName = g.RepoName
+	result.Path = g.GitRoot
+
+	// Report local changes in the working tree.
+	status, err := g.status(ctx)
+	if err != nil {
+		return fail(fmt.Errorf("Error checking status for %s\n%w", g.RepoName, err))
+	}
+	result.Status = status.counts()
+
+	// Check if the remote exists, git exits with status 2 when there is no such remote.
+	result.RemoteURL, err = g.remoteURL(ctx)
+	var gitErr *GitError
+	if errors.As(err, &gitErr) && gitErr.ExitCode == 2 {
+		return skip(fmt.Errorf("No remote named '%s' found for %s", g.RemoteName, g.RepoName))
+	}
+	if err != nil {
+		return fail(fmt.Errorf("Error getting the url of remote %s for %s: %w", g.RemoteName, g.RepoName, err))
 	}
 
 	// Proceed with fetching the branches from the remote.
-	if fErr := g.fetchBranches(); err != nil {
-		results <- fmt.Sprintf("%sError fetching %s. %v%s", LightRed, g.RepoName, fErr, Reset)
-		return false
+	if fErr := g.fetchBranches(ctx, result.RemoteURL); fErr != nil {
+		return fail(fmt.Errorf("Error fetching %s. %w", g.RepoName, fErr))
+	}
+
+	// Resolve the default branch of the remote.
+	if g.Branch == BranchAuto {
+		g.Branch, err = g.defaultBranch(ctx)
+		if err != nil {
+			return skip(fmt.Errorf("Could not detect the default branch of %s/%s: %w", g.RepoName, g.RemoteName, err))
+		}
+		result.Branch = g.Branch
 	}
 
 	// Check if the branch exists locally.
-	if !g.branchExistsLocally() {
-		results <- fmt.Sprintf("Branch %s does not exist in repository %s", g.Branch, g.RepoName)
-		return false
+	if !g.branchExistsLocally(ctx) {
+		return skip(fmt.Errorf("Branch %s does not exist in repository %s", g.Branch, g.RepoName))
 	}
 
 	// Check if the branch exists remotely.
-	if !g.branchExistsRemotely() {
-		results <- fmt.Sprintf("Remote branch %s does not exist in repository %s", g.Branch, g.RepoName)
-		return false
+	if !g.branchExistsRemotely(ctx) {
+		return skip(fmt.Errorf("Remote branch %s does not exist in repository %s", g.Branch, g.RepoName))
 	}
 
-	// Check if the local branch is behind the remote branch.
-	behindCount, err := g.commitsBehind()
+	// Check if the local branch is ahead of or behind the remote branch.
+	result.Ahead, result.Behind, err = g.commitsAheadBehind(ctx)
 	if err != nil {
-		results <- err.Error()
-		return false
+		return fail(err)
+	}
+	result.State = classifyState(result.Ahead, result.Behind)
+
+	// Already up-to-date, or only ahead so there is nothing to pull.
+	if result.Behind == 0 {
+		results <- result
+		return result.State == StateAhead
+	}
+
+	// Find the last commit for the report.
+	result.LastCommit, err = g.lastCommit(ctx)
+	if err != nil {
+		return fail(err)
+	}
+
+	if !g.Update {
+		results <- result
+		return true
+	}
+
+	// A diverged branch cannot be fast-forwarded.
+	if result.State == StateDiverged && g.Strategy == StrategyFFOnly {
+		errorMsg := fmt.Sprintf("has diverged from %s/%s and cannot be fast-forwarded", g.RemoteName, g.Branch)
+		solution := "To update anyway use --strategy rebase or --strategy merge"
+		return fail(fmt.Errorf("%s %s.\n%s.", g.RepoName, errorMsg, solution))
 	}
 
-	// Check if the repository is outdated.
-	if behindCount != "0" {
-		// Find the last commit for the report.
-		lastCommitInfo, lErr := g.lastCommit()
-		if lErr != nil {
-			results <- lErr.Error()
-			return false
+	prepared, pErr := prepareWorkingTree(ctx, g, &result.Actions)
+	if pErr != nil {
+		return fail(pErr)
+	}
+	stash = prepared.stash
+	original, _ = g.currentBranch(ctx)
+
+	// Journal the state before the update so it can be undone.
+	if !g.DryRun {
+		entry := JournalEntry{
+			Path:          g.GitRoot,
+			Branch:        original,
+			Stash:         prepared.stash,
+			Aborted:       prepared.aborted,
+			UpdatedBranch: g.Branch,
+		}
+		// Without the commits before the update the journal could not undo it, so don't update at all.
+		if entry.Head, err = g.headCommit(ctx); err != nil {
+			return fail(fmt.Errorf("Error reading HEAD of %s: %w", g.RepoName, err))
+		}
+		if entry.UpdatedFrom, err = g.resolveCommit(ctx, "refs/heads/"+g.Branch); err != nil {
+			return fail(fmt.Errorf("Error reading branch %s of %s: %w", g.Branch, g.RepoName, err))
 		}
+		if err = cfg.Journal.record(entry); err != nil {
+			return fail(fmt.Errorf("Error writing the journal of %s: %w", g.RepoName, err))
+		}
+		result.Journal = &entry
+	}
 
-		params = []any{LightRed, g.RepoName, behindCount, commitText(behindCount), lastCommitInfo, Reset}
-		result := fmt.Sprintf("%s\n%s is %s %s behind\nLast commit by %s%s", params...)
+	if original != g.Branch {
+		result.Actions = append(result.Actions, fmt.Sprintf("Checking out branch %s", g.Branch))
+	}
+	if !g.DryRun {
+		if err = g.checkoutBranch(ctx, g.Branch); err != nil {
+			return fail(fmt.Errorf("Error checking out branch %s in repository %s: %w", g.Branch, g.RepoName, err))
+		}
+	}
 
-		if g.Update {
-			result += "\n:."
-			statusLines, sErr := g.status()
-			if sErr != nil {
-				results <- fmt.Sprintf("%sError checking status for %s\n%s%s", LightRed, g.RepoName, sErr, Reset)
-				return false
-			}
+	// Report the planned pull and stop before touching the repository.
+	if g.DryRun {
+		pull := fmt.Sprintf("Pulling latest changes (%s, fast-forward)", g.Strategy)
+		if result.State == StateDiverged {
+			pull = fmt.Sprintf("Pulling latest changes (%s, cannot fast-forward)", g.Strategy)
+		}
+		result.Actions = append(result.Actions, pull)
+		if prepared.hasChanges {
+			result.Actions = append(result.Actions, "Applying stashed changes")
+		}
+		results <- result
+		return true
+	}
 
-			// Check if there is an ongoing rebase or merge conflict.
-			isConflict, isRebase := hasConflicts(statusLines)
-
-			if isConflict {
-				// Don't force the update.
-				if !g.Force {
-					errorMsg := "has merge conflicts in file(s) or there's a rebase in progress"
-					solution := "To update anyway use --update --force. This aborts rebase and merge conflicts"
-					results <- fmt.Sprintf("%s%s %s.\n%s.%s", LightRed, g.RepoName, errorMsg, solution, Reset)
-					return false
-				}
-
-				// Force the update by aborting processes.
-				result += fmt.Sprintf("\n%s Forcing update...%s", LightRed, Reset)
-				if isRebase {
-					if g.abortRebase() {
-						results <- fmt.Sprintf("%sError aborting rebase %s%s", LightRed, g.RepoName, Reset)
-						return false
-					}
-				} else {
-					if g.abortMerge() {
-						results <- fmt.Sprintf("%sError aborting merge %s%s", LightRed, g.RepoName, Reset)
-						return false
-					}
-				}
+	result.Actions = append(result.Actions, fmt.Sprintf("Pulling latest changes (%s)", g.Strategy))
+	if err = g.pullLatest(ctx); err != nil {
+		// Leave the repository as it was rather than in the middle of a rebase or merge. The abort runs even
+		// when ctx is cancelled, as the interrupted pull is what left the rebase or merge behind.
+		rollbackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), RollbackTimeout)
+		defer cancel()
+		var aErr error
+		switch g.Strategy {
+		case StrategyRebase:
+			if aErr = g.abortRebase(rollbackCtx); aErr == nil {
+				result.Actions = append(result.Actions, "Aborted rebase")
 			}
-
-			if hasStagedChanges(statusLines) {
-				result += "\n Stashing local changes"
-				if !g.stashChanges() {
-					results <- fmt.Sprintf("%sError stashing changes in %s%s", LightRed, g.RepoName, Reset)
-					return false
-				}
+		case StrategyMerge:
+			if aErr = g.abortMerge(rollbackCtx); aErr == nil {
+				result.Actions = append(result.Actions, "Aborted merge")
 			}
+		}
+		if aErr != nil {
+			result.Actions = append(result.Actions, fmt.Sprintf("Error aborting %s: %v", g.Strategy, aErr))
+		}
+		return fail(fmt.Errorf("Error pulling %s/%s in repository %s: %w", g.RemoteName, g.Branch, g.RepoName, err))
+	}
 
-			if !g.checkoutBranch() {
-				params = []any{LightRed, g.Branch, g.RepoName, Reset}
-				results <- fmt.Sprintf("%sError checking out branch %s in repository %s%s", params...)
-				return false
-			}
+	// The branch is updated, so finish journaling it and reapplying the stash even when ctx is cancelled meanwhile.
+	finishCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), RollbackTimeout)
+	defer cancel()
+	if result.Journal.UpdatedTo, err = g.resolveCommit(finishCtx, "refs/heads/"+g.Branch); err != nil {
+		// An entry without the commit the branch moved to would tell undo the branch never moved.
+		result.Journal = nil
+		if rErr := cfg.Journal.remove(g.GitRoot); rErr != nil {
+			err = errors.Join(err, rErr)
+		}
+		return fail(fmt.Errorf("Error reading branch %s of %s after the update, it cannot be undone: %w",
+			g.Branch, g.RepoName, err))
+	}
+	if err = cfg.Journal.record(*result.Journal); err != nil {
+		return fail(fmt.Errorf("Error writing the journal of %s, the update cannot be undone: %w", g.RepoName, err))
+	}
 
-			result += "\n Pulling latest changes"
-			if !g.pullLatest() {
-				params = []any{LightRed, g.RemoteName, g.Branch, g.RepoName, Reset}
-				results <- fmt.Sprintf("%sError pulling %s/%s in repository %s%s", params...)
-				return false
-			}
+	if stash != "" {
+		result.Actions = append(result.Actions, "Applying stashed changes")
+		stashCommit := stash
+		stash = ""
+		if err = g.applyStash(finishCtx, stashCommit); err != nil {
+			return fail(fmt.Errorf("Error applying stash %s: %w\nChanges remain stashed, restore them with: "+
+				"rp stash restore %s", shortHash(stashCommit), err, g.RepoName))
+		}
+	}
 
-			if g.isReporterStash() {
-				result += "\n Applying stashed changes"
-				if !g.applyStash() {
-					results <- fmt.Sprintf("%sError applying stash%s", LightRed, Reset)
-					return false
-				}
+	// Report actions taken.
+	result.Updated = true
+	results <- result
+	return true
+}
+
+// preparedTree records the changes prepareWorkingTree made to the working tree.
+type preparedTree struct {
+	// hasChanges is set when there are local changes to stash, also in a dry run.
+	hasChanges bool
+	// stash is the commit of the stash made.
+	stash string
+	// aborted is the operation aborted.
+	aborted Operation
+}
+
+// prepareWorkingTree gets the working tree ready to be changed, aborting a rebase, merge or other operation
+// in progress when forced and stashing local changes, and records the actions taken. In a dry run the actions
+// are only recorded.
+func prepareWorkingTree(ctx context.Context, g *GitExecutor, actions *[]string) (preparedTree, error) {
+	var prepared preparedTree
+	status, err := g.status(ctx)
+	if err != nil {
+		return prepared, fmt.Errorf("Error checking status for %s\n%w", g.RepoName, err)
+	}
+
+	// Check if there is a rebase, merge or other operation in progress.
+	op, err := g.operationInProgress(ctx)
+	if err != nil {
+		return prepared, fmt.Errorf("Error checking for operations in progress in %s\n%w", g.RepoName, err)
+	}
+
+	if op != OperationNone {
+		// Don't force the update.
+		if !g.Force {
+			solution := fmt.Sprintf("To update anyway use --update --force. This aborts the %s", op)
+			return prepared, fmt.Errorf("%s has a %s in progress.\n%s.", g.RepoName, op, solution)
+		}
+
+		// Force the update by aborting the operation.
+		*actions = append(*actions, fmt.Sprintf("Forcing update, aborting %s", op))
+		prepared.aborted = op
+		if !g.DryRun {
+			if err = g.abortOperation(ctx, op); err != nil {
+				return prepared, fmt.Errorf("Error aborting %s %s: %w", op, g.RepoName, err)
+			}
+			// Aborting the operation changes the working tree.
+			if status, err = g.status(ctx); err != nil {
+				return prepared, fmt.Errorf("Error checking status for %s\n%w", g.RepoName, err)
 			}
+		}
+	}
+
+	// Conflicts left without an operation, e.g. by a stash pop, have nothing to abort.
+	if status.hasConflicts() && (op == OperationNone || !g.DryRun) {
+		return prepared, fmt.Errorf("%s has merge conflicts in file(s).\nResolve the conflicts first.", g.RepoName)
+	}
 
-			result += fmt.Sprintf("\n%s %s is up-to-date%s", LightGreen, g.RepoName, Reset)
+	counts := status.counts()
+	prepared.hasChanges = counts.Staged+counts.Unstaged > 0 || (g.StashUntracked && counts.Untracked > 0)
+	if prepared.hasChanges {
+		if g.StashUntracked && counts.Untracked > 0 {
+			*actions = append(*actions, "Stashing local changes, including untracked files")
+		} else {
+			*actions = append(*actions, "Stashing local changes")
+		}
+		if !g.DryRun {
+			if prepared.stash, err = g.stashChanges(ctx); err != nil {
+				return prepared, fmt.Errorf("Error stashing changes in %s: %w", g.RepoName, err)
+			}
 		}
+	}
+	return prepared, nil
+}
 
-		// Report actions taken.
-		results <- result + Reset
-		return true
+// restoreStash puts back changes stashed by an update that stopped part way, checking out the original branch
+// first. It runs even when ctx is cancelled so an interrupted update never leaves changes behind in the stash.
+func restoreStash(ctx context.Context, g *GitExecutor, original, stash string) []string {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), RollbackTimeout)
+	defer cancel()
+
+	var actions []string
+	if current, _ := g.currentBranch(ctx); original != "" && current != original {
+		if err := g.checkoutBranch(ctx, original); err != nil {
+			return append(actions, fmt.Sprintf("Error checking out branch %s, changes remain stashed: %v", original,
+				err))
+		}
+		actions = append(actions, fmt.Sprintf("Checked out branch %s", original))
+	}
+	if err := g.applyStash(ctx, stash); err != nil {
+		return append(actions, fmt.Sprintf("Error restoring stashed changes: %v, restore them with: "+
+			"rp stash restore %s", err, g.RepoName))
 	}
-	// Already up-to-date.
-	results <- fmt.Sprintf("%s%s is up-to-date%s", LightGreen, g.RepoName, Reset)
-	return false
+	return append(actions, "Restored stashed changes")
 }
@@ -4,18 +4,68 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config holds configuration values.
 type Config struct {
-	Branch     string   `yaml:"branch"`
-	Update     bool     `yaml:"update"`
-	Include    []string `yaml:"include"`
-	Exclude    []string `yaml:"exclude"`
-	Force      bool     `yaml:"force"`
-	RemoteName string   `yaml:"remote_name"`
+	Branch         string                `yaml:"branch"`
+	Update         bool                  `yaml:"update"`
+	Include        []string              `yaml:"include"`
+	Exclude        []string              `yaml:"exclude"`
+	Force          bool                  `yaml:"force"`
+	RemoteName     string                `yaml:"remote_name"`
+	MaxDepth       int                   `yaml:"max_depth"`
+	Output         string                `yaml:"output"`
+	Strategy       string                `yaml:"update_strategy"`
+	StashUntracked bool                  `yaml:"stash_untracked"`
+	Jobs           int                   `yaml:"jobs"`
+	Timeout        time.Duration         `yaml:"timeout"`
+	CommandTimeout time.Duration         `yaml:"command_timeout"`
+	Retry          RetryConfig           `yaml:"retry"`
+	Repos          map[string]RepoConfig `yaml:"repos"`
+	Groups         map[string][]string   `yaml:"groups"`
+	Manifest       []ManifestEntry       `yaml:"manifest"`
+	SelectedGroups []string              `yaml:"-"`
+	DryRun         bool                  `yaml:"-"`
+	Verbose        bool                  `yaml:"-"`
+	RunID          string                `yaml:"-"`
+	Started        time.Time             `yaml:"-"`
+	Journal        *runJournal           `yaml:"-"`
+	Runner         GitRunner             `yaml:"-"`
+	Root           string                `yaml:"-"`
+	ConfigDir      string                `yaml:"-"`
+}
+
+// RetryConfig holds the retry policy of network operations. Only transient failures are retried, waiting
+// BaseDelay after the first attempt and twice as long after every next one, up to MaxDelay.
+type RetryConfig struct {
+	Attempts  int           `yaml:"attempts"`
+	BaseDelay time.Duration `yaml:"base_delay"`
+	MaxDelay  time.Duration `yaml:"max_delay"`
+}
+
+// ManifestEntry describes a repository of the workspace, so it can be cloned when missing.
+// Its path is relative to the directory of the configuration file.
+type ManifestEntry struct {
+	Path   string `yaml:"path"`
+	URL    string `yaml:"url"`
+	Branch string `yaml:"branch"`
+}
+
+// RepoConfig holds the overrides for repositories matching a name or path glob.
+// Unset values fall back to the global configuration.
+type RepoConfig struct {
+	Branch     string `yaml:"branch"`
+	Update     *bool  `yaml:"update"`
+	Force      *bool  `yaml:"force"`
+	RemoteName string `yaml:"remote_name"`
+	Strategy   string `yaml:"update_strategy"`
 }
 
 // loadConfig reads the configuration file.
@@ -40,12 +90,23 @@ func loadConfig(configPath string) (Config, error) {
 	}
 	// Validate configuration keys.
 	validKeys := map[string]bool{
-		"branch":      true,
-		"update":      true,
-		"include":     true,
-		"exclude":     true,
-		"force":       true,
-		"remote_name": true,
+		"branch":          true,
+		"update":          true,
+		"include":         true,
+		"exclude":         true,
+		"force":           true,
+		"remote_name":     true,
+		"max_depth":       true,
+		"output":          true,
+		"update_strategy": true,
+		"stash_untracked": true,
+		"jobs":            true,
+		"timeout":         true,
+		"command_timeout": true,
+		"retry":           true,
+		"repos":           true,
+		"groups":          true,
+		"manifest":        true,
 	}
 	// Deserialize data into convenient map for key checking.
 	var rawConfig map[string]any
@@ -56,9 +117,176 @@ func loadConfig(configPath string) (Config, error) {
 	if err = validateKeys(rawConfig, validKeys); err != nil {
 		return config, err
 	}
+	if err = validateRepoKeys(rawConfig); err != nil {
+		return config, err
+	}
+	if err = validateManifest(rawConfig, config.Manifest); err != nil {
+		return config, err
+	}
+	if err = validateRetry(rawConfig, config.Retry); err != nil {
+		return config, err
+	}
+	if _, ok := rawConfig["jobs"]; ok {
+		if err = validateJobs(config.Jobs); err != nil {
+			return config, fmt.Errorf("%sError %v%s", LightRed, err, Reset)
+		}
+	}
 	return config, nil
 }
 
+// validateJobs validates the number of repositories checked concurrently, set in .rprc or with --jobs.
+func validateJobs(jobs int) error {
+	if jobs < 1 {
+		return fmt.Errorf("jobs must be at least 1, got %d", jobs)
+	}
+	return nil
+}
+
+// validateRetry validates the yaml keys and values of the retry policy.
+func validateRetry(rawConfig map[string]any, retry RetryConfig) error {
+	if keys, ok := rawConfig["retry"].(map[string]any); ok {
+		validKeys := map[string]bool{
+			"attempts":   true,
+			"base_delay": true,
+			"max_delay":  true,
+		}
+		if err := validateKeys(keys, validKeys); err != nil {
+			return err
+		}
+	}
+	if retry.Attempts < 0 || retry.BaseDelay < 0 || retry.MaxDelay < 0 {
+		return fmt.Errorf("%sError retry attempts and delays cannot be negative%s", LightRed, Reset)
+	}
+	if retry.MaxDelay > 0 && retry.MaxDelay < retry.BaseDelay {
+		return fmt.Errorf("%sError retry max_delay cannot be shorter than base_delay%s", LightRed, Reset)
+	}
+	return nil
+}
+
+// validateManifest validates the yaml keys and required values of every manifest entry.
+func validateManifest(rawConfig map[string]any, manifest []ManifestEntry) error {
+	entries, _ := rawConfig["manifest"].([]any)
+	validKeys := map[string]bool{
+		"path":   true,
+		"url":    true,
+		"branch": true,
+	}
+	for _, entry := range entries {
+		if keys, ok := entry.(map[string]any); ok {
+			if err := validateKeys(keys, validKeys); err != nil {
+				return err
+			}
+		}
+	}
+	for _, entry := range manifest {
+		if entry.Path == "" || entry.URL == "" {
+			return fmt.Errorf("%sError manifest entries require a path and url%s", LightRed, Reset)
+		}
+	}
+	return nil
+}
+
+// manifestPath returns the absolute path of a manifest entry.
+func (c Config) manifestPath(entry ManifestEntry) string {
+	if filepath.IsAbs(entry.Path) {
+		return filepath.Clean(entry.Path)
+	}
+	return filepath.Join(c.ConfigDir, entry.Path)
+}
+
+// validateRepoKeys validates the yaml keys of every per-repository override.
+func validateRepoKeys(rawConfig map[string]any) error {
+	repos, ok := rawConfig["repos"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	validKeys := map[string]bool{
+		"branch":          true,
+		"update":          true,
+		"force":           true,
+		"remote_name":     true,
+		"update_strategy": true,
+	}
+	for _, repo := range repos {
+		overrides, isMap := repo.(map[string]any)
+		if !isMap {
+			continue
+		}
+		if err := validateKeys(overrides, validKeys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forRepo returns the configuration for the repository at dir with the branch from its manifest entry and
+// matching overrides merged over the global defaults. Overrides are matched by repository name, glob or
+// regular expression, as in the include and exclude lists. Glob matches are applied in key order, followed
+// by an exact name match so the most specific entry wins.
+func (c Config) forRepo(dir string) Config {
+	for _, entry := range c.Manifest {
+		if entry.Branch != "" && c.manifestPath(entry) == filepath.Clean(dir) {
+			c.Branch = entry.Branch
+		}
+	}
+	if len(c.Repos) == 0 {
+		return c
+	}
+	name := filepath.Base(dir)
+	relPath := relativePath(c.Root, dir)
+
+	keys := make([]string, 0, len(c.Repos))
+	for key := range c.Repos {
+		if key != name {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	repoCfg := c
+	for _, key := range keys {
+		if matchesRepo(key, name, relPath) {
+			repoCfg = repoCfg.withOverrides(c.Repos[key])
+		}
+	}
+	if overrides, ok := c.Repos[name]; ok {
+		repoCfg = repoCfg.withOverrides(overrides)
+	}
+	return repoCfg
+}
+
+// withOverrides returns a copy of the configuration with the set override values applied.
+func (c Config) withOverrides(overrides RepoConfig) Config {
+	if overrides.Branch != "" {
+		c.Branch = overrides.Branch
+	}
+	if overrides.Update != nil {
+		c.Update = *overrides.Update
+	}
+	if overrides.Force != nil {
+		c.Force = *overrides.Force
+	}
+	if overrides.RemoteName != "" {
+		c.RemoteName = overrides.RemoteName
+	}
+	if overrides.Strategy != "" {
+		c.Strategy = overrides.Strategy
+	}
+	return c
+}
+
+// relativePath returns dir relative to root using forward slashes, or dir itself when it is not below root.
+func relativePath(root, dir string) string {
+	if root == "" {
+		return dir
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return dir
+	}
+	return filepath.ToSlash(rel)
+}
+
 // validateKeys validates the yaml config keys.
 func validateKeys(config map[string]any, validKeys map[string]bool) error {
 	for key := range config {
@@ -69,6 +297,16 @@ func validateKeys(config map[string]any, validKeys map[string]bool) error {
 	return nil
 }
 
+// defaultJobs returns the default number of repositories checked concurrently.
+func defaultJobs() int {
+	return min(runtime.NumCPU(), MaxDefaultJobs)
+}
+
+// isValidStrategy checks if the update strategy is supported.
+func isValidStrategy(strategy string) bool {
+	return strategy == StrategyFFOnly || strategy == StrategyRebase || strategy == StrategyMerge
+}
+
 // findConfigFile looks for the .rprc file in the current and parent directories.
 func findConfigFile(currentDir string) (string, error) {
 	configPath := filepath.Join(currentDir, ".rprc")
@@ -83,16 +321,59 @@ func findConfigFile(currentDir string) (string, error) {
 }
 
 // isIncluded checks if a repository is included based on the include and exclude lists.
-func isIncluded(repoName string, include, exclude []string) bool {
+// Both lists hold names, globs or "re:" prefixed regular expressions matched against the repository
+// name and its path relative to the root.
+func isIncluded(repoName, relPath string, include, exclude []string) bool {
 	for _, inc := range include {
-		if inc == repoName {
+		if matchesRepo(inc, repoName, relPath) {
 			return true
 		}
 	}
 	for _, exc := range exclude {
-		if exc == repoName {
+		if matchesRepo(exc, repoName, relPath) {
 			return false
 		}
 	}
 	return len(include) == 0
 }
+
+// isSelected checks if the repository at dir is in one of the selected groups, if any, and passes the
+// include and exclude lists.
+func (c Config) isSelected(dir string) bool {
+	repoName := filepath.Base(dir)
+	relPath := relativePath(c.Root, dir)
+	if len(c.SelectedGroups) > 0 && !c.inGroups(repoName, relPath) {
+		return false
+	}
+	return isIncluded(repoName, relPath, c.Include, c.Exclude)
+}
+
+// inGroups checks if the repository matches a member of any selected group.
+func (c Config) inGroups(repoName, relPath string) bool {
+	for _, group := range c.SelectedGroups {
+		for _, member := range c.Groups[group] {
+			if matchesRepo(member, repoName, relPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stringList is a flag that can be repeated or given a comma separated list of values.
+type stringList []string
+
+// String returns the values as a comma separated list.
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set adds the comma separated values to the list.
+func (s *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*s = append(*s, v)
+		}
+	}
+	return nil
+}
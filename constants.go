@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 // ANSI escape codes.
 const (
 	// LightRed style for text.
@@ -9,26 +11,51 @@ const (
 	// Reset style.
 	Reset = "\033[0m"
 
-	// Unmerged means the file is unmerged, meaning there is a conflict.
-	Unmerged = "U "
-	// UnmergedAdded means the file is unmerged, and the file on the other branch was added.
-	UnmergedAdded = "UA"
-	// UnmergedDeleted means the file is unmerged, and the file on the current branch was deleted.
-	UnmergedDeleted = "UD"
-	// MergeConflictBothSides means both the file in the current branch and the file being merged have conflicts.
-	MergeConflictBothSides = "UU"
-
-	// StagedAdded means an added file staged change.
-	StagedAdded = "A "
-	// StagedModified means a modified file staged change.
-	StagedModified = "M "
-	// StagedDeleted means a deleted file staged change.
-	StagedDeleted = "D "
-	// StagedRenamed means a renamed file staged change.
-	StagedRenamed = "R "
-	// StagedCopied means a copied file staged change.
-	StagedCopied = "C "
-
-	// MaxAttempts represents maximum reties.
+	// MaxAttempts represents the default maximum number of attempts of a network operation.
 	MaxAttempts = 5
+
+	// OutputText selects the colored human readable report.
+	OutputText = "text"
+	// OutputJSON selects the machine-readable JSON report.
+	OutputJSON = "json"
+
+	// BranchAuto resolves the branch of each repository to the default branch of its remote.
+	BranchAuto = "auto"
+
+	// StrategyFFOnly only updates branches that can be fast-forwarded.
+	StrategyFFOnly = "ff-only"
+	// StrategyRebase rebases local commits onto the remote branch.
+	StrategyRebase = "rebase"
+	// StrategyMerge merges the remote branch into the local branch.
+	StrategyMerge = "merge"
+
+	// MaxDefaultJobs caps the default number of concurrent checks, staying below common SSH MaxStartups limits.
+	MaxDefaultJobs = 8
+
+	// DefaultMaxDepth represents the default number of directory levels searched for repositories.
+	DefaultMaxDepth = 3
+
+	// GitDateLayout is the default date format of git log, used to show commit dates in text reports.
+	GitDateLayout = "Mon Jan 2 15:04:05 2006 -0700"
 )
+
+// Timeouts and delays applied to git commands.
+const (
+	// DefaultCommandTimeout represents the default time a single git command may run.
+	DefaultCommandTimeout = 2 * time.Minute
+	// DefaultRetryBaseDelay represents the default delay before retrying a failed network operation.
+	DefaultRetryBaseDelay = 100 * time.Millisecond
+	// DefaultRetryMaxDelay represents the default maximum delay between retries.
+	DefaultRetryMaxDelay = 5 * time.Second
+	// RollbackTimeout represents the time allowed to restore a repository after an interrupted update.
+	RollbackTimeout = 30 * time.Second
+)
+
+// SkippedDirs lists directories that are never searched for repositories.
+var SkippedDirs = []string{
+	"node_modules",
+	"vendor",
+	"bower_components",
+	"__pycache__",
+	"target",
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// findRepositories walks the directory tree below root and returns the path of every git repository found.
+// The walk descends into regular directories, stops at repository roots, skips heavy dependency directories
+// and never goes deeper than maxDepth levels below root. A maxDepth below one means no limit.
+func findRepositories(root string, maxDepth int) ([]string, error) {
+	var repos []string
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are skipped rather than aborting the whole walk.
+			if d != nil && d.IsDir() && path != root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if isSkippedDir(d.Name()) {
+			return filepath.SkipDir
+		}
+		if isRepositoryRoot(path) {
+			repos = append(repos, path)
+			return filepath.SkipDir
+		}
+		if maxDepth > 0 && depthOf(root, path) >= maxDepth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return repos, err
+}
+
+// isRepositoryRoot checks if a directory is the root of a git repository, worktree or submodule.
+func isRepositoryRoot(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// isSkippedDir checks if a directory should never be searched for repositories.
+func isSkippedDir(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, skip := range SkippedDirs {
+		if skip == name {
+			return true
+		}
+	}
+	return false
+}
+
+// depthOf returns how many levels below root the path is.
+func depthOf(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return len(strings.Split(rel, string(filepath.Separator)))
+}
@@ -2,238 +2,435 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"math/big"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/sony/gobreaker"
 )
 
 // GitExecutor executes git commands for the reporter.
 type GitExecutor struct {
-	Branch     string
-	Update     bool
-	Force      bool
-	RemoteName string
-	RepoName   string
-	GitRoot    string
+	Branch         string
+	Update         bool
+	Force          bool
+	DryRun         bool
+	RemoteName     string
+	Strategy       string
+	StashUntracked bool
+	RunID          string
+	Retry          RetryConfig
+	CommandTimeout time.Duration
+	RepoName       string
+	GitRoot        string
+	Runner         GitRunner
 }
 
 // NewGitExecutor returns a new GitExecutor.
 func NewGitExecutor(cfg Config, gitRoot string, repoName string) *GitExecutor {
 	return &GitExecutor{
-		Branch:     cfg.Branch,
-		Update:     cfg.Update,
-		Force:      cfg.Force,
-		RemoteName: cfg.RemoteName,
-		RepoName:   repoName,
-		GitRoot:    gitRoot,
+		Branch:         cfg.Branch,
+		Update:         cfg.Update,
+		Force:          cfg.Force,
+		DryRun:         cfg.DryRun,
+		RemoteName:     cfg.RemoteName,
+		Strategy:       cfg.Strategy,
+		StashUntracked: cfg.StashUntracked,
+		RunID:          cfg.RunID,
+		Retry:          cfg.Retry,
+		CommandTimeout: cfg.CommandTimeout,
+		RepoName:       repoName,
+		GitRoot:        gitRoot,
+		Runner:         cfg.gitRunner(),
 	}
 }
 
-// hasRemoteURL checks if the git repository has a remote url defined.
-func (g *GitExecutor) hasRemoteURL() bool {
-	cmd := exec.Command("git", "-C", g.GitRoot, "remote", "get-url", g.RemoteName)
-	if err := cmd.Run(); err != nil {
-		return false
+// run runs a git command in the repository that is killed when ctx is done or the command times out.
+// Failures are returned as a *GitError.
+func (g *GitExecutor) run(ctx context.Context, args ...string) (GitOutput, error) {
+	if g.CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.CommandTimeout)
+		defer cancel()
 	}
-	return true
+	return runGit(ctx, g.Runner, g.GitRoot, args...)
+}
+
+// remoteURL gets the remote url for the repository.
+func (g *GitExecutor) remoteURL(ctx context.Context) (string, error) {
+	output, err := g.run(ctx, "remote", "get-url", g.RemoteName)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output.Stdout), nil
 }
 
-// fetchBranches fetches the branches from the remote and retries on failures.
-func (g *GitExecutor) fetchBranches() error {
-	cmd := exec.Command("git", "-C", g.GitRoot, "fetch", g.RemoteName)
-	return execCommandWithRetry(cmd, g.GitRoot, g.RemoteName, MaxAttempts)
+// fetchBranches fetches the branches from the remote at remoteURL and retries on failures. Failures are returned
+// as a RemoteError with the host of the remote.
+func (g *GitExecutor) fetchBranches(ctx context.Context, remoteURL string) error {
+	host := remoteHost(remoteURL)
+	fetch := func() (GitOutput, error) {
+		return g.run(ctx, "fetch", g.RemoteName)
+	}
+	if err := execCommandWithRetry(ctx, fetch, host, remoteURL, g.Retry); err != nil {
+		return &RemoteError{Host: host, Err: err}
+	}
+	return nil
+}
+
+// defaultBranch resolves the default branch of the remote from refs/remotes/<remote>/HEAD,
+// falling back to asking the remote which branch its HEAD points to.
+func (g *GitExecutor) defaultBranch(ctx context.Context) (string, error) {
+	headRef := fmt.Sprintf("refs/remotes/%s/HEAD", g.RemoteName)
+	output, err := g.run(ctx, "symbolic-ref", "--short", "-q", headRef)
+	if err == nil {
+		branch := strings.TrimPrefix(strings.TrimSpace(output.Stdout), g.RemoteName+"/")
+		if branch != "" {
+			return branch, nil
+		}
+	}
+
+	output, err = g.run(ctx, "ls-remote", "--symref", g.RemoteName, "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return parseSymref(output.Stdout)
 }
 
 // branchExistsLocally checks if the desired branch exists locally.
-func (g *GitExecutor) branchExistsLocally() bool {
-	cmd := exec.Command("git", "-C", g.GitRoot, "rev-parse", "--verify", g.Branch)
-	if err := cmd.Run(); err != nil {
+func (g *GitExecutor) branchExistsLocally(ctx context.Context) bool {
+	if _, err := g.run(ctx, "rev-parse", "--verify", g.Branch); err != nil {
 		return false
 	}
 	return true
 }
 
 // branchExistsRemotely checks if the desired branch exists remotely.
-func (g *GitExecutor) branchExistsRemotely() bool {
+func (g *GitExecutor) branchExistsRemotely(ctx context.Context) bool {
 	remoteBranch := fmt.Sprintf("%s/%s", g.RemoteName, g.Branch)
-	cmd := exec.Command("git", "-C", g.GitRoot, "rev-parse", "--verify", remoteBranch)
-	if err := cmd.Run(); err != nil {
+	if _, err := g.run(ctx, "rev-parse", "--verify", remoteBranch); err != nil {
 		return false
 	}
 	return true
 }
 
-// commitsBehind retrieves a string representation of the number of commits the local branch is behind the remote.
-func (g *GitExecutor) commitsBehind() (string, error) {
-	branchExpression := fmt.Sprintf("%s..%s/%s", g.Branch, g.RemoteName, g.Branch)
-	cmd := exec.Command("git", "-C", g.GitRoot, "rev-list", "--count", branchExpression)
-	output, err := cmd.Output()
+// commitsAheadBehind retrieves the number of commits the local branch is ahead of and behind the remote.
+func (g *GitExecutor) commitsAheadBehind(ctx context.Context) (ahead int, behind int, err error) {
+	branchExpression := fmt.Sprintf("%s...%s/%s", g.Branch, g.RemoteName, g.Branch)
+	output, err := g.run(ctx, "rev-list", "--left-right", "--count", branchExpression)
 	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			params := []any{LightRed, g.RepoName, string(exitError.Stderr), exitError.ExitCode(), Reset}
-			return "", fmt.Errorf("%sError checking rev-list %s: %s (exit status %d)%s", params...)
-		}
-		return "", fmt.Errorf("%sError checking rev-list %s: %v%s", LightRed, g.RepoName, err, Reset)
+		return 0, 0, fmt.Errorf("Error checking rev-list %s: %w", g.RepoName, err)
 	}
-	return strings.TrimSpace(string(output)), nil
+	ahead, behind, err = parseLeftRightCount(output.Stdout)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Error parsing rev-list count %s: %w", g.RepoName, err)
+	}
+	return ahead, behind, nil
 }
 
-// lastCommit retrieves the last commit ahead of local and formats it.
-func (g *GitExecutor) lastCommit() (string, error) {
-	logFormat := "--pretty=format:%an %ad\n%h %s"
-	cmd := exec.Command("git", "-C", g.GitRoot, "log", "-1", logFormat)
-	cmd.Env = append(os.Environ(), "LC_TIME=C") // Standardize date format
-	authorCommitOutput, err := cmd.Output()
+// lastCommit retrieves the last commit on the remote branch, the newest commit ahead of local.
+func (g *GitExecutor) lastCommit(ctx context.Context) (*Commit, error) {
+	logFormat := "--pretty=format:%H%x1f%h%x1f%an%x1f%aI%x1f%s"
+	remoteBranch := fmt.Sprintf("%s/%s", g.RemoteName, g.Branch)
+	output, err := g.run(ctx, "log", "-1", logFormat, remoteBranch)
 	if err != nil {
-		return "", fmt.Errorf("%sError checking last commit author %s: %v%s", LightRed, g.RepoName, err, Reset)
+		return nil, fmt.Errorf("Error checking last commit author %s: %w", g.RepoName, err)
 	}
-	return strings.TrimSpace(string(authorCommitOutput)), nil
+	return parseCommit(strings.TrimSpace(output.Stdout))
 }
 
-// status returns the porcelain formatted git status for the repository.
-func (g *GitExecutor) status() ([]string, error) {
-	statusOutput, err := exec.Command("git", "-C", g.GitRoot, "status", "--porcelain").CombinedOutput()
+// status returns the parsed git status of the working tree and its branch.
+func (g *GitExecutor) status(ctx context.Context) (GitStatus, error) {
+	output, err := g.run(ctx, "status", "--porcelain=v2", "--branch", "-z")
 	if err != nil {
-		return []string{}, err
+		return GitStatus{}, err
 	}
-	// Split the status output into individual lines.
-	return strings.Split(strings.TrimSpace(string(statusOutput)), "\n"), nil
+	return parseStatus(output.Stdout)
 }
 
 // abortRebase aborts a rebase in progress.
-func (g *GitExecutor) abortRebase() bool {
-	cmd := exec.Command("git", "-C", g.GitRoot, "rebase", "--abort")
-	if err := cmd.Run(); err != nil {
-		return false
-	}
-	return true
+func (g *GitExecutor) abortRebase(ctx context.Context) error {
+	_, err := g.run(ctx, "rebase", "--abort")
+	return err
 }
 
 // abortMerge aborts a merge in progress.
-func (g *GitExecutor) abortMerge() bool {
-	cmd := exec.Command("git", "-C", g.GitRoot, "merge", "--abort")
-	if err := cmd.Run(); err != nil {
-		return false
+func (g *GitExecutor) abortMerge(ctx context.Context) error {
+	_, err := g.run(ctx, "merge", "--abort")
+	return err
+}
+
+// operationInProgress returns the rebase, merge or other operation in progress in the repository.
+func (g *GitExecutor) operationInProgress(ctx context.Context) (Operation, error) {
+	output, err := g.run(ctx, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return OperationNone, err
 	}
-	return true
+	return detectOperation(strings.TrimSpace(output.Stdout)), nil
 }
 
-// stashChanges stashes any uncommitted changes.
-func (g *GitExecutor) stashChanges() bool {
-	cmd := exec.Command("git", "-C", g.GitRoot, "stash", "push", "-m", "Stashed by reporter")
-	if err := cmd.Run(); err != nil {
-		return false
+// abortOperation aborts the operation in progress.
+func (g *GitExecutor) abortOperation(ctx context.Context, op Operation) error {
+	_, err := g.run(ctx, op.abortArgs()...)
+	return err
+}
+
+// stashChanges stashes any uncommitted changes, including untracked files when configured, with a message
+// tagged with the run id. It returns the commit of the new stash.
+func (g *GitExecutor) stashChanges(ctx context.Context) (string, error) {
+	message := stashMessage(g.RunID, time.Now())
+	args := []string{"stash", "push", "-m", message}
+	if g.StashUntracked {
+		args = append(args, "--include-untracked")
 	}
-	return true
+	if _, err := g.run(ctx, args...); err != nil {
+		return "", err
+	}
+
+	// Find the stash by its message rather than assuming it is stash@{0}.
+	entries, err := g.stashEntries(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Subject, ": "+message) {
+			return entry.Commit, nil
+		}
+	}
+	return "", errors.New("no stash was created, there are no local changes to stash")
 }
 
-// applyStash reapplies the stash made by the reporter.
-func (g *GitExecutor) applyStash() bool {
-	cmd := exec.Command("git", "-C", g.GitRoot, "stash", "pop")
-	if err := cmd.Run(); err != nil {
-		return false
+// applyStash applies the stash with the given commit and drops it from the stash list. The stash is kept
+// when applying it fails, e.g. on conflicts.
+func (g *GitExecutor) applyStash(ctx context.Context, stash string) error {
+	if _, found := g.stashIndex(ctx, stash); !found {
+		return fmt.Errorf("stash %s is not in the stash list", shortHash(stash))
 	}
-	return true
+	if _, err := g.run(ctx, "stash", "apply", stash); err != nil {
+		return err
+	}
+	return g.dropStash(ctx, stash)
 }
 
-// pullLatest pulls the latest changes from the remote branch.
-func (g *GitExecutor) pullLatest() bool {
-	cmd := exec.Command("git", "-C", g.GitRoot, "pull", g.RemoteName, g.Branch)
-	if err := cmd.Run(); err != nil {
-		return false
+// dropStash drops the stash with the given commit from the stash list.
+func (g *GitExecutor) dropStash(ctx context.Context, stash string) error {
+	index, found := g.stashIndex(ctx, stash)
+	if !found {
+		return fmt.Errorf("stash %s is not in the stash list", shortHash(stash))
 	}
-	return true
+	_, err := g.run(ctx, "stash", "drop", "-q", fmt.Sprintf("stash@{%d}", index))
+	return err
 }
 
-// checkoutBranch checkouts the specified branch in the git root.
-func (g *GitExecutor) checkoutBranch() bool {
-	cmd := exec.Command("git", "-C", g.GitRoot, "checkout", g.Branch)
-	if err := cmd.Run(); err != nil {
-		return false
+// stashIndex returns the position of the stash with the given commit in the stash list.
+func (g *GitExecutor) stashIndex(ctx context.Context, stash string) (int, bool) {
+	entries, err := g.stashEntries(ctx)
+	if err != nil {
+		return 0, false
 	}
-	return true
+	for i, entry := range entries {
+		if entry.Commit == stash {
+			return i, true
+		}
+	}
+	return 0, false
 }
 
-// isReporterStash checks if the most recent stash was stashed by reporter.
-func (g *GitExecutor) isReporterStash() bool {
-	var out bytes.Buffer
-	cmd := exec.Command("git", "-C", g.GitRoot, "stash", "list")
-	cmd.Stdout = &out
-	_ = cmd.Run()
-	if strings.Contains(out.String(), fmt.Sprintf("stash@{0}: On %s: Stashed by reporter", g.Branch)) {
-		return true
+// stashFiles returns the files changed in a stash, including the untracked files it holds.
+func (g *GitExecutor) stashFiles(ctx context.Context, stash string) ([]string, error) {
+	output, err := g.run(ctx, "stash", "show", "--name-only", "--include-untracked", stash)
+	if err != nil {
+		return nil, err
 	}
-	return false
+	return strings.Fields(output.Stdout), nil
 }
 
-// Global circuit breaker instance.
-var cb *gobreaker.CircuitBreaker
+// stashEntry is a single entry of the stash list.
+type stashEntry struct {
+	Commit  string
+	Subject string
+}
 
-func init() {
-	settings := gobreaker.Settings{
-		Name:        "GitCommandCircuitBreaker",
-		MaxRequests: MaxAttempts,
-		Interval:    time.Minute,
-		Timeout:     time.Minute,
-		ReadyToTrip: func(counts gobreaker.Counts) bool {
-			return counts.ConsecutiveFailures > 3
-		},
+// stashEntries returns the stash list, most recent first.
+func (g *GitExecutor) stashEntries(ctx context.Context) ([]stashEntry, error) {
+	output, err := g.run(ctx, "stash", "list", "--format=%H%x1f%gs")
+	if err != nil {
+		return nil, err
+	}
+	var entries []stashEntry
+	for _, line := range strings.Split(strings.TrimSpace(output.Stdout), "\n") {
+		if commit, subject, found := strings.Cut(line, "\x1f"); found {
+			entries = append(entries, stashEntry{Commit: commit, Subject: subject})
+		}
 	}
-	cb = gobreaker.NewCircuitBreaker(settings)
+	return entries, nil
 }
 
-// execCommandWithRetry retries the command a number of times with exponential backoff and jitter.
-func execCommandWithRetry(cmd *exec.Cmd, gitRoot string, remoteName string, maxAttempts int) error {
-	var (
-		remoteURL string
-		err       error
-	)
+// pullLatest pulls the latest changes from the remote branch using the configured update strategy.
+func (g *GitExecutor) pullLatest(ctx context.Context) error {
+	args := append([]string{"pull"}, pullStrategyArgs(g.Strategy)...)
+	_, err := g.run(ctx, append(args, g.RemoteName, g.Branch)...)
+	return err
+}
+
+// pullStrategyArgs returns the git pull flags for the update strategy, overriding any pull.rebase and pull.ff
+// settings. A merge fast-forwards when it can and merges otherwise, even when pull.ff is set to only.
+func pullStrategyArgs(strategy string) []string {
+	switch strategy {
+	case StrategyRebase:
+		return []string{"--rebase"}
+	case StrategyMerge:
+		return []string{"--no-rebase", "--ff"}
+	default:
+		return []string{"--ff-only"}
+	}
+}
+
+// currentBranch returns the name of the checked out branch, or an error when HEAD is detached.
+func (g *GitExecutor) currentBranch(ctx context.Context) (string, error) {
+	output, err := g.run(ctx, "symbolic-ref", "--short", "-q", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output.Stdout), nil
+}
+
+// headCommit returns the commit hash HEAD points to.
+func (g *GitExecutor) headCommit(ctx context.Context) (string, error) {
+	return g.resolveCommit(ctx, "HEAD")
+}
 
+// resolveCommit returns the commit hash of a revision, or an error when it does not exist locally.
+func (g *GitExecutor) resolveCommit(ctx context.Context, rev string) (string, error) {
+	output, err := g.run(ctx, "rev-parse", "--verify", "-q", rev+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output.Stdout), nil
+}
+
+// resetHard resets the current branch, index and working tree to the commit.
+func (g *GitExecutor) resetHard(ctx context.Context, commit string) error {
+	_, err := g.run(ctx, "reset", "-q", "--hard", commit)
+	return err
+}
+
+// checkoutDetached checks out the commit with a detached HEAD.
+func (g *GitExecutor) checkoutDetached(ctx context.Context, commit string) error {
+	_, err := g.run(ctx, "checkout", "--detach", commit)
+	return err
+}
+
+// checkoutBranch checkouts the specified branch in the git root.
+func (g *GitExecutor) checkoutBranch(ctx context.Context, branch string) error {
+	_, err := g.run(ctx, "checkout", branch)
+	return err
+}
+
+// execCommandWithRetry runs a command through the circuit breaker of the remote host, retrying transient
+// failures with exponential backoff and jitter as configured by the retry policy. A command can only run once,
+// so attempt runs a fresh command, with its own timeout, on every attempt.
+func execCommandWithRetry(
+	ctx context.Context,
+	attempt func() (GitOutput, error),
+	host, remoteURL string,
+	retry RetryConfig,
+) error {
 	// Circuit Breaker: Avoids repeatedly attempting operations that are likely to fail.
-	_, err = cb.Execute(func() (any, error) {
-		for attempts := 1; attempts <= maxAttempts; attempts++ {
-			err = cmd.Run()
+	return breakers.execute(host, func() error {
+		for attempts := 1; ; attempts++ {
+			output, err := attempt()
 			if err == nil {
-				return nil, nil
+				return nil
+			}
+
+			// Stop retrying once the run is interrupted or timed out.
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
 
-			if attempts == maxAttempts {
-				// Write error message.
-				remoteURL, err = getRemoteURL(gitRoot, remoteName)
-				return nil, errRepoDoesNotExist(remoteURL, err)
+			// Permanent failures, e.g. bad credentials, fail the same way on every attempt.
+			if attempts >= retry.Attempts || classifyGitError(output.Stderr) == classPermanent {
+				return retryFailure(remoteURL, output.Stderr, attempts, err)
 			}
 			// Exponential backoff with jitter.
 			// Exponential Backoff: Helps in reducing the load during retries.
 			// Jitter: Prevents synchronized retries, "thundering herd" problem.
-			var jitter int64
-			jitter, err = generateRandomInt(100)
+			delay := retry.backoff(attempts)
+			jitter, err := generateRandomInt(int64(delay/4) + 1)
 			if err != nil {
-				return nil, err
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay + time.Duration(jitter)):
 			}
-			sleepDuration := time.Millisecond * time.Duration(50*(1<<attempts)+jitter)
-			time.Sleep(sleepDuration)
 		}
-		return nil, fmt.Errorf("Command failed after %d attempts.", maxAttempts)
 	})
+}
+
+// retryFailure returns the error of a command that failed on its last attempt, wrapping the error of that
+// attempt. A missing remote repository is explained in plain words first.
+func retryFailure(remoteURL, stderr string, attempts int, err error) error {
+	attemptText := "attempts"
+	if attempts == 1 {
+		attemptText = "attempt"
+	}
+	err = fmt.Errorf("%w (failed after %d %s)", err, attempts, attemptText)
+
+	lower := strings.ToLower(stderr)
+	missing := strings.Contains(lower, "repository not found") ||
+		strings.Contains(lower, "does not appear to be a git repository")
+	if _, _, pErr := parseGitRemoteURL(remoteURL); missing && pErr == nil {
+		return fmt.Errorf("%w\n%w", errRepoDoesNotExist(remoteURL, nil), err)
+	}
 	return err
 }
 
+// gitCommand returns a git command run in dir that is killed when ctx is done.
+// Credential prompts are disabled so a command can never block waiting for input.
+func gitCommand(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "LC_TIME=C") // Standardize date format
+	return cmd
+}
+
+// cloneRepository clones the remote url into dir, checking out branch when one is set.
+func cloneRepository(ctx context.Context, remoteURL, dir, branch string) error {
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0o750); err != nil {
+		return fmt.Errorf("Error creating %s: %w", parent, err)
+	}
+	args := []string{"clone"}
+	if branch != "" && branch != BranchAuto {
+		args = append(args, "--branch", branch)
+	}
+	args = append(args, "--", remoteURL, dir)
+
+	var stderr bytes.Buffer
+	cmd := gitCommand(ctx, parent, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Error cloning %s into %s: %s", remoteURL, dir, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
 // getGitRoot returns the root directory of the Git repository.
-func getGitRoot(dir string) (string, error) {
-	cmd := exec.Command("git", "rev-parse", "--show-toplevel")
-	cmd.Dir = dir
-	output, err := cmd.Output()
+func getGitRoot(ctx context.Context, runner GitRunner, dir string) (string, error) {
+	output, err := runGit(ctx, runner, dir, "rev-parse", "--show-toplevel")
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(string(output)), nil
+	return strings.TrimSpace(output.Stdout), nil
 }
 
 // generateRandomInt returns a random integer between 0 and max-1 using crypto/rand.
@@ -258,16 +455,6 @@ func errRepoDoesNotExist(remoteURL string, err error) error {
 	return fmt.Errorf("The remote repository %s/%s may not exist or was deleted.", user, repo)
 }
 
-// getRemoteURL gets the remote url for the repository.
-func getRemoteURL(gitRoot string, remoteName string) (string, error) {
-	cmd := exec.Command("git", "-C", gitRoot, "remote", "get-url", remoteName)
-	output, err := cmd.Output()
-	if err != nil {
-		return "", err
-	}
-	return strings.TrimSpace(string(output)), nil
-}
-
 // parseGitRemoteURL normalizes and then parses the remote url of the repository.
 func parseGitRemoteURL(remoteURL string) (user string, repo string, err error) {
 	// Handle different remote URL formats.
@@ -295,43 +482,77 @@ func parseGitRemoteURL(remoteURL string) (user string, repo string, err error) {
 	return user, repo, nil
 }
 
-// hasStagedChanges examines each line for the presence of staged changes.
-func hasStagedChanges(statusLines []string) bool {
-	for _, line := range statusLines {
-		if strings.HasPrefix(line, StagedAdded) || strings.HasPrefix(line, StagedModified) ||
-			strings.HasPrefix(line, StagedDeleted) || strings.HasPrefix(line, StagedRenamed) ||
-			strings.HasPrefix(line, StagedCopied) {
-			return true
+// parseSymref parses the branch HEAD points to from the output of ls-remote --symref.
+func parseSymref(output string) (string, error) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD" {
+			return strings.TrimPrefix(fields[1], "refs/heads/"), nil
 		}
 	}
-	return false
+	return "", errors.New("remote HEAD is not a symbolic ref")
 }
 
-// hasConflicts examines each line for the presence of conflicts.
-func hasConflicts(statusLines []string) (isConflict bool, isRebase bool) {
-	for _, line := range statusLines {
-		if strings.HasPrefix(line, Unmerged) || strings.HasPrefix(line, MergeConflictBothSides) ||
-			strings.HasPrefix(line, UnmergedDeleted) || strings.HasPrefix(line, UnmergedAdded) {
-			isConflict = true
-			if strings.HasPrefix(line, "UU") {
-				isRebase = true
-			}
-		}
+// parseLeftRightCount parses the "<left>\t<right>" output of rev-list --left-right --count.
+func parseLeftRightCount(output string) (left int, right int, err error) {
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("unexpected rev-list output: %q", output)
+	}
+	if left, err = strconv.Atoi(fields[0]); err != nil {
+		return 0, 0, err
+	}
+	if right, err = strconv.Atoi(fields[1]); err != nil {
+		return 0, 0, err
+	}
+	return left, right, nil
+}
+
+// classifyState returns the repository state for the number of commits ahead of and behind the remote.
+func classifyState(ahead, behind int) RepoState {
+	switch {
+	case ahead > 0 && behind > 0:
+		return StateDiverged
+	case behind > 0:
+		return StateBehind
+	case ahead > 0:
+		return StateAhead
+	default:
+		return StateUpToDate
 	}
-	return isConflict, isRebase
+}
+
+// parseCommit parses a commit formatted as unit separated hash, short hash, author, strict ISO 8601 date and
+// subject.
+func parseCommit(line string) (*Commit, error) {
+	fields := strings.SplitN(line, "\x1f", 5)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("unexpected commit format: %q", line)
+	}
+	return &Commit{
+		Hash:      fields[0],
+		ShortHash: fields[1],
+		Author:    fields[2],
+		Date:      fields[3],
+		Subject:   fields[4],
+	}, nil
 }
 
 // commitText conditionally returns the singular or plural form of the commit text.
-func commitText(behindCount string) string {
-	if behindCount == "1" {
+func commitText(count int) string {
+	if count == 1 {
 		return "commit"
 	}
 	return "commits"
 }
 
-// runGitLog runs the git log command to show the complete list of changes.
-func runGitLog(dir, remoteName, branch string) error {
-	cmd := exec.Command("git", "log", fmt.Sprintf("%s..%s/%s", branch, remoteName, branch))
+// runGitLog runs the git log command to show the complete list of changes, optionally in the pager.
+func runGitLog(dir, remoteName, branch string, pager bool) error {
+	args := []string{"log", fmt.Sprintf("%s..%s/%s", branch, remoteName, branch)}
+	if !pager {
+		args = append([]string{"--no-pager"}, args...)
+	}
+	cmd := exec.Command("git", args...)
 	cmd.Dir = dir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
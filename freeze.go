@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Lock records the exact state of the repositories of a workspace.
+type Lock struct {
+	Repositories []LockEntry `yaml:"repositories"`
+}
+
+// LockEntry records the state of a single repository. Its path is relative to the directory frozen, and thaw
+// resolves it against the directory it runs in.
+type LockEntry struct {
+	Path      string `yaml:"path"`
+	Branch    string `yaml:"branch,omitempty"`
+	Commit    string `yaml:"commit"`
+	RemoteURL string `yaml:"remote_url,omitempty"`
+}
+
+// runFreeze writes a lock file recording the HEAD commit, branch and remote url of every selected repository.
+func runFreeze(ctx context.Context, cfg Config) error {
+	repos, _, err := selectRepositories(cfg)
+	if err != nil {
+		return err
+	}
+
+	lock := Lock{Repositories: make([]LockEntry, 0, len(repos))}
+	for _, dir := range repos {
+		g := NewGitExecutor(cfg.forRepo(dir), dir, filepath.Base(dir))
+		commit, hErr := g.headCommit(ctx)
+		if hErr != nil {
+			fmt.Fprintf(os.Stderr, "%sError reading HEAD of %s: %v%s\n", LightRed, g.RepoName, hErr, Reset)
+			continue
+		}
+		branch, _ := g.currentBranch(ctx)
+		remoteURL, _ := g.remoteURL(ctx)
+		lock.Repositories = append(lock.Repositories, LockEntry{
+			Path:      relativePath(cfg.Root, dir),
+			Branch:    branch,
+			Commit:    commit,
+			RemoteURL: remoteURL,
+		})
+	}
+
+	output, err := yaml.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# Generated by rp freeze. Paths are relative to the directory frozen, restore them by running\n"+
+		"# rp thaw <file> from that directory.\n%s", output)
+	return nil
+}
+
+// loadLock reads a lock file written by runFreeze. Paths must be relative and stay within the directory
+// thawed, so a lock file cannot clone or check out repositories anywhere else on disk.
+func loadLock(lockPath string) (Lock, error) {
+	var lock Lock
+	file, err := os.ReadFile(lockPath)
+	if err != nil {
+		return lock, err
+	}
+	if err = yaml.Unmarshal(file, &lock); err != nil {
+		return lock, fmt.Errorf("reading lock file %s: %w", lockPath, err)
+	}
+	for _, entry := range lock.Repositories {
+		if entry.Path == "" || entry.Commit == "" {
+			return lock, fmt.Errorf("lock file %s: entries require a path and commit", lockPath)
+		}
+		if !filepath.IsLocal(filepath.FromSlash(entry.Path)) {
+			return lock, fmt.Errorf("lock file %s: path %s must be relative to the directory frozen", lockPath,
+				entry.Path)
+		}
+	}
+	return lock, nil
+}
+
+// runThaw checks out every repository in the lock file at args[0] to its recorded commit.
+func runThaw(ctx context.Context, cfg Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: rp thaw <lock file>")
+	}
+	lock, err := loadLock(args[0])
+	if err != nil {
+		return err
+	}
+
+	results := make([]CheckResult, len(lock.Repositories))
+	runConcurrently(len(results), cfg.Jobs, func(i int) {
+		results[i] = thawRepository(ctx, cfg, lock.Repositories[i])
+	})
+
+	if cfg.Output == OutputJSON {
+		return renderJSON(os.Stdout, results, cfg)
+	}
+	fmt.Printf("\nRestoring Repositories From %s\n\n", args[0])
+	sortResults(results)
+	for _, result := range results {
+		fmt.Println(formatRestoreResult(result, cfg))
+	}
+	fmt.Println()
+	return nil
+}
+
+// thawRepository checks out the repository to the commit recorded in the lock entry. The recorded branch is
+// checked out when it still points at the commit, otherwise the commit is checked out with a detached HEAD.
+// Missing repositories are cloned and local changes are stashed and reapplied, as in the update path.
+func thawRepository(ctx context.Context, cfg Config, entry LockEntry) CheckResult {
+	dir := filepath.Join(cfg.Root, filepath.FromSlash(entry.Path))
+	result := CheckResult{
+		RepoName:   filepath.Base(dir),
+		Path:       dir,
+		Branch:     entry.Branch,
+		RemoteURL:  entry.RemoteURL,
+		LastCommit: &Commit{Hash: entry.Commit, ShortHash: shortHash(entry.Commit)},
+		DryRun:     cfg.DryRun,
+	}
+
+	// fail reports the repository as failed with the given error.
+	fail := func(err error) CheckResult {
+		result.State = StateError
+		result.Err = err
+		return result
+	}
+
+	if ctx.Err() != nil {
+		result.State = StateSkipped
+		result.Err = fmt.Errorf("Skipped %s: %v", result.RepoName, ctx.Err())
+		return result
+	}
+
+	if !isRepositoryRoot(dir) {
+		if entry.RemoteURL == "" {
+			return fail(fmt.Errorf("%s is missing and has no remote url to clone", entry.Path))
+		}
+		result.Actions = append(result.Actions, fmt.Sprintf("Cloning %s", entry.RemoteURL))
+		if cfg.DryRun {
+			result.Actions = append(result.Actions, fmt.Sprintf("Checking out %s", shortHash(entry.Commit)))
+			return result
+		}
+		if err := cloneRepository(ctx, entry.RemoteURL, dir, ""); err != nil {
+			return fail(err)
+		}
+	}
+
+	g := NewGitExecutor(cfg.forRepo(dir), dir, result.RepoName)
+	result.Remote = g.RemoteName
+	head, _ := g.headCommit(ctx)
+	original, _ := g.currentBranch(ctx)
+
+	// Prefer the recorded branch when it still points at the recorded commit.
+	target := ""
+	if entry.Branch != "" {
+		if tip, _ := g.resolveCommit(ctx, "refs/heads/"+entry.Branch); tip == entry.Commit {
+			target = entry.Branch
+		}
+	}
+	result.Branch = target
+	if head == entry.Commit && original == target {
+		result.State = StateUpToDate
+		return result
+	}
+
+	// Fetch commits that are not available locally yet.
+	if _, err := g.resolveCommit(ctx, entry.Commit); err != nil {
+		result.Actions = append(result.Actions, fmt.Sprintf("Fetching %s", g.RemoteName))
+		if !cfg.DryRun {
+			remoteURL, _ := g.remoteURL(ctx)
+			if fErr := g.fetchBranches(ctx, remoteURL); fErr != nil {
+				return fail(fmt.Errorf("Error fetching %s. %w", g.RepoName, fErr))
+			}
+			if _, err = g.resolveCommit(ctx, entry.Commit); err != nil {
+				return fail(fmt.Errorf("Commit %s not found in %s", entry.Commit, g.RepoName))
+			}
+		}
+	}
+
+	prepared, err := prepareWorkingTree(ctx, g, &result.Actions)
+	if err != nil {
+		return fail(err)
+	}
+	stash := prepared.stash
+
+	var cErr error
+	if target != "" {
+		result.Actions = append(result.Actions, fmt.Sprintf("Checking out branch %s", target))
+		if !cfg.DryRun {
+			cErr = g.checkoutBranch(ctx, target)
+		}
+	} else {
+		result.Actions = append(result.Actions, fmt.Sprintf("Checking out %s", shortHash(entry.Commit)))
+		if !cfg.DryRun {
+			cErr = g.checkoutDetached(ctx, entry.Commit)
+		}
+	}
+	if cErr != nil {
+		if stash != "" {
+			result.Actions = append(result.Actions, restoreStash(ctx, g, original, stash)...)
+		}
+		return fail(fmt.Errorf("Error checking out %s in repository %s: %w", shortHash(entry.Commit), g.RepoName,
+			cErr))
+	}
+
+	// Put the local changes back, as the update path does, keeping them stashed when they no longer apply.
+	if prepared.hasChanges {
+		result.Actions = append(result.Actions, "Applying stashed changes")
+		if !cfg.DryRun {
+			if err = g.applyStash(ctx, stash); err != nil {
+				return fail(fmt.Errorf("Error applying stash %s: %w\nChanges remain stashed, restore them with: "+
+					"rp stash restore %s", shortHash(stash), err, g.RepoName))
+			}
+		}
+	}
+	result.State = StateUpToDate
+	result.Updated = !cfg.DryRun
+	return result
+}
+
+// formatRestoreResult formats the outcome of restoring a single repository, by thaw or undo, as colored text.
+func formatRestoreResult(result CheckResult, cfg Config) string {
+	if result.State == StateSkipped {
+		return result.Err.Error()
+	}
+
+	ref := result.LastCommit.ShortHash
+	if result.Branch != "" {
+		ref = fmt.Sprintf("%s (%s)", ref, result.Branch)
+	}
+	text := fmt.Sprintf("%s%s is at %s%s", LightGreen, result.RepoName, ref, Reset)
+	if result.State == StateError {
+		text = fmt.Sprintf("%s%v%s%s", LightRed, result.Err, gitErrorDetails(result.Err, cfg), Reset)
+	}
+
+	if len(result.Actions) > 0 {
+		text += "\n:."
+		if result.DryRun {
+			text += " (dry run)"
+		}
+		for _, action := range result.Actions {
+			text += "\n " + action
+		}
+	}
+	return text
+}
+
+// shortHash abbreviates a commit hash for display.
+func shortHash(hash string) string {
+	return hash[:min(len(hash), 7)]
+}
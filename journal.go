@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Journal records the state of every repository before it was changed by a run, so the run can be undone.
+type Journal struct {
+	RunID        string         `yaml:"run_id"`
+	Started      time.Time      `yaml:"started"`
+	Repositories []JournalEntry `yaml:"repositories"`
+}
+
+// JournalEntry records the state of a single repository before it was updated.
+type JournalEntry struct {
+	Path string `yaml:"path"`
+	// Branch and Head are the branch checked out, if any, and the HEAD commit before the update.
+	Branch string `yaml:"branch,omitempty"`
+	Head   string `yaml:"head"`
+	// Stash is the commit of the stash holding the local changes, and Aborted the operation aborted.
+	Stash   string    `yaml:"stash,omitempty"`
+	Aborted Operation `yaml:"aborted,omitempty"`
+	// UpdatedBranch is the branch pulled into, which pointed at UpdatedFrom before and UpdatedTo after the pull.
+	UpdatedBranch string `yaml:"updated_branch"`
+	UpdatedFrom   string `yaml:"updated_from"`
+	UpdatedTo     string `yaml:"updated_to,omitempty"`
+}
+
+// journalDir returns the directory journals are kept in, following the XDG base directory specification.
+func journalDir() (string, error) {
+	if stateHome := os.Getenv("XDG_STATE_HOME"); stateHome != "" {
+		return filepath.Join(stateHome, "reporter", "runs"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", "reporter", "runs"), nil
+}
+
+// runJournal writes the journal of an update run as repositories are changed, so a run that is killed part
+// way can still be undone.
+type runJournal struct {
+	mu      sync.Mutex
+	path    string
+	err     error
+	journal Journal
+}
+
+// newRunJournal returns the journal of the run. Nothing is written until a repository is recorded.
+func newRunJournal(cfg Config) *runJournal {
+	dir, err := journalDir()
+	return &runJournal{
+		path:    filepath.Join(dir, cfg.RunID+".yaml"),
+		err:     err,
+		journal: Journal{RunID: cfg.RunID, Started: cfg.Started.UTC()},
+	}
+}
+
+// record saves the state of a repository before it is changed, replacing the entry of the same repository.
+// A nil journal records nothing.
+func (j *runJournal) record(entry JournalEntry) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.journal.Repositories = slices.DeleteFunc(j.journal.Repositories, func(e JournalEntry) bool {
+		return e.Path == entry.Path
+	})
+	j.journal.Repositories = append(j.journal.Repositories, entry)
+	sort.Slice(j.journal.Repositories, func(i, k int) bool {
+		return j.journal.Repositories[i].Path < j.journal.Repositories[k].Path
+	})
+	return j.save()
+}
+
+// remove drops the entry of the repository at path, removing the journal once it is empty.
+func (j *runJournal) remove(path string) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.journal.Repositories = slices.DeleteFunc(j.journal.Repositories, func(e JournalEntry) bool {
+		return e.Path == path
+	})
+	if len(j.journal.Repositories) == 0 {
+		if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return j.save()
+}
+
+// written returns whether any repository was recorded.
+func (j *runJournal) written() bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.journal.Repositories) > 0
+}
+
+// save writes the journal. It is written to a temporary file first, so a run killed while writing never
+// leaves a truncated journal behind.
+func (j *runJournal) save() error {
+	if j.err != nil {
+		return j.err
+	}
+	output, err := yaml.Marshal(j.journal)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(j.path), 0o750); err != nil {
+		return err
+	}
+	if err = os.WriteFile(j.path+".tmp", output, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(j.path+".tmp", j.path)
+}
+
+// loadJournal reads the journal of the run from dir, or of the latest run when runID is empty. Entries must
+// record the commits needed to undo the update.
+func loadJournal(dir, runID string) (Journal, error) {
+	var journal Journal
+	if runID == "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+		if err != nil {
+			return journal, err
+		}
+		if len(files) == 0 {
+			return journal, errors.New("no runs to undo")
+		}
+		// Run ids start with the time of the run, so the last file is the latest run.
+		sort.Strings(files)
+		runID = strings.TrimSuffix(filepath.Base(files[len(files)-1]), ".yaml")
+	}
+
+	file, err := os.ReadFile(filepath.Join(dir, runID+".yaml"))
+	if errors.Is(err, os.ErrNotExist) {
+		return journal, fmt.Errorf("no journal found for run %s", runID)
+	}
+	if err != nil {
+		return journal, err
+	}
+	if err = yaml.Unmarshal(file, &journal); err != nil {
+		return journal, fmt.Errorf("reading journal of run %s: %w", runID, err)
+	}
+	for _, entry := range journal.Repositories {
+		if entry.Path == "" || entry.Head == "" || entry.UpdatedBranch == "" || entry.UpdatedFrom == "" {
+			return journal, fmt.Errorf("journal of run %s: entries require a path, head, updated_branch and "+
+				"updated_from", runID)
+		}
+	}
+	return journal, nil
+}
+
+// reportUndo prints how to undo the run when it changed repositories.
+func reportUndo(cfg Config) {
+	if cfg.Journal.written() && cfg.Output != OutputJSON {
+		fmt.Printf("Undo this run with: rp undo %s\n\n", cfg.RunID)
+	}
+}
+
+// runUndo restores every repository changed by the run with the id in args, or by the latest run, to its
+// state before the run.
+func runUndo(ctx context.Context, cfg Config, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: rp undo [run-id]")
+	}
+	dir, err := journalDir()
+	if err != nil {
+		return err
+	}
+	runID := ""
+	if len(args) == 1 {
+		runID = args[0]
+	}
+	journal, err := loadJournal(dir, runID)
+	if err != nil {
+		return err
+	}
+
+	results := make([]CheckResult, len(journal.Repositories))
+	runConcurrently(len(results), cfg.Jobs, func(i int) {
+		results[i] = undoRepository(ctx, cfg, journal.Repositories[i])
+	})
+
+	// Keep the journal until every repository is restored, so a failed undo can be retried.
+	undone := !cfg.DryRun
+	for _, result := range results {
+		undone = undone && result.State != StateError && result.State != StateSkipped
+	}
+	if undone {
+		if err = os.Remove(filepath.Join(dir, journal.RunID+".yaml")); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Output == OutputJSON {
+		return renderJSON(os.Stdout, results, cfg)
+	}
+	fmt.Printf("\nUndoing Run %s\n\n", journal.RunID)
+	sortResults(results)
+	for _, result := range results {
+		fmt.Println(formatRestoreResult(result, cfg))
+	}
+	fmt.Println()
+	return nil
+}
+
+// undoRepository restores the repository to the state recorded in the journal entry. The updated branch is
+// reset to its commit before the update, the original branch is checked out and the stashed changes are
+// reapplied. Local changes made since the update are stashed first and reapplied last. A branch with new
+// commits since the update is only reset with --force.
+func undoRepository(ctx context.Context, cfg Config, entry JournalEntry) CheckResult {
+	result := CheckResult{
+		RepoName:   filepath.Base(entry.Path),
+		Path:       entry.Path,
+		Branch:     entry.Branch,
+		LastCommit: &Commit{Hash: entry.Head, ShortHash: shortHash(entry.Head)},
+		DryRun:     cfg.DryRun,
+	}
+
+	// fail reports the repository as failed with the given error.
+	fail := func(err error) CheckResult {
+		result.State = StateError
+		result.Err = err
+		return result
+	}
+
+	if ctx.Err() != nil {
+		result.State = StateSkipped
+		result.Err = fmt.Errorf("Skipped %s: %v", result.RepoName, ctx.Err())
+		return result
+	}
+	if !isRepositoryRoot(entry.Path) {
+		return fail(fmt.Errorf("%s no longer exists", entry.Path))
+	}
+
+	g := NewGitExecutor(cfg.forRepo(entry.Path), entry.Path, result.RepoName)
+
+	// Only reset the updated branch when the update moved it, and nothing else did since.
+	reset := false
+	if entry.UpdatedTo != "" && entry.UpdatedTo != entry.UpdatedFrom {
+		tip, _ := g.resolveCommit(ctx, "refs/heads/"+entry.UpdatedBranch)
+		reset = tip != entry.UpdatedFrom
+		if reset && tip != entry.UpdatedTo && !g.Force {
+			return fail(fmt.Errorf("%s has new commits on %s since the update.\nTo undo anyway use --force.",
+				result.RepoName, entry.UpdatedBranch))
+		}
+	}
+
+	// Find the checkout needed to get back to the original branch, or commit when HEAD was detached.
+	original, _ := g.currentBranch(ctx)
+	current := original
+	if reset {
+		current = entry.UpdatedBranch
+	}
+	head, _ := g.headCommit(ctx)
+	checkoutBranch := entry.Branch != "" && entry.Branch != current
+	checkoutDetached := entry.Branch == "" && (current != "" || head != entry.Head)
+
+	// Local changes only need to be stashed when the undo changes the working tree.
+	var prepared preparedTree
+	if reset || checkoutBranch || checkoutDetached {
+		var err error
+		if prepared, err = prepareWorkingTree(ctx, g, &result.Actions); err != nil {
+			return fail(err)
+		}
+	}
+
+	// restore reports the failure, restoring the local changes stashed by the undo.
+	restore := func(err error) CheckResult {
+		if prepared.stash != "" {
+			result.Actions = append(result.Actions, restoreStash(ctx, g, original, prepared.stash)...)
+		}
+		return fail(err)
+	}
+
+	if reset {
+		result.Actions = append(result.Actions, fmt.Sprintf("Resetting %s to %s", entry.UpdatedBranch,
+			shortHash(entry.UpdatedFrom)))
+		if !cfg.DryRun {
+			err := g.checkoutBranch(ctx, entry.UpdatedBranch)
+			if err == nil {
+				err = g.resetHard(ctx, entry.UpdatedFrom)
+			}
+			if err != nil {
+				return restore(fmt.Errorf("Error resetting %s in repository %s: %w", entry.UpdatedBranch,
+					result.RepoName, err))
+			}
+		}
+	}
+
+	if checkoutBranch {
+		result.Actions = append(result.Actions, fmt.Sprintf("Checking out branch %s", entry.Branch))
+		if !cfg.DryRun {
+			if err := g.checkoutBranch(ctx, entry.Branch); err != nil {
+				return restore(fmt.Errorf("Error checking out branch %s in repository %s: %w", entry.Branch,
+					result.RepoName, err))
+			}
+		}
+	}
+	if checkoutDetached {
+		result.Actions = append(result.Actions, fmt.Sprintf("Checking out %s", shortHash(entry.Head)))
+		if !cfg.DryRun {
+			if err := g.checkoutDetached(ctx, entry.Head); err != nil {
+				return restore(fmt.Errorf("Error checking out %s in repository %s: %w", shortHash(entry.Head),
+					result.RepoName, err))
+			}
+		}
+	}
+
+	// The stash of the update is still in the stash list when it could not be reapplied after the pull.
+	if _, found := g.stashIndex(ctx, entry.Stash); entry.Stash != "" && found {
+		result.Actions = append(result.Actions, fmt.Sprintf("Applying stash %s", shortHash(entry.Stash)))
+		if !cfg.DryRun {
+			if err := g.applyStash(ctx, entry.Stash); err != nil {
+				return fail(fmt.Errorf("Error applying stash %s: %w\nChanges remain stashed, restore them with: "+
+					"rp stash restore %s", shortHash(entry.Stash), err, result.RepoName))
+			}
+		}
+	}
+	if prepared.hasChanges {
+		result.Actions = append(result.Actions, "Applying stashed changes")
+		if !cfg.DryRun {
+			if err := g.applyStash(ctx, prepared.stash); err != nil {
+				return fail(fmt.Errorf("Error applying stash %s: %w\nChanges remain stashed, restore them with: "+
+					"rp stash restore %s", shortHash(prepared.stash), err, result.RepoName))
+			}
+		}
+	}
+
+	if entry.Aborted != OperationNone {
+		result.Actions = append(result.Actions, fmt.Sprintf("The %s aborted by the run cannot be restored", entry.Aborted))
+	}
+	result.State = StateUpToDate
+	result.Updated = !cfg.DryRun
+	return result
+}
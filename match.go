@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks a pattern as a regular expression rather than a shell glob.
+const regexPrefix = "re:"
+
+// matchesRepo checks if the pattern matches the repository name or its slash separated path relative to the root.
+// Patterns prefixed with "re:" are regular expressions, anything else is a shell glob where "**" matches any
+// number of directories. Invalid patterns only match literally.
+func matchesRepo(pattern, repoName, relPath string) bool {
+	if pattern == repoName || pattern == relPath {
+		return true
+	}
+	if expr, ok := strings.CutPrefix(pattern, regexPrefix); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return false
+		}
+		return re.MatchString(repoName) || re.MatchString(relPath)
+	}
+	if !strings.Contains(pattern, "/") {
+		if matched, err := path.Match(pattern, repoName); err == nil && matched {
+			return true
+		}
+	}
+	return matchGlob(strings.Split(pattern, "/"), strings.Split(relPath, "/"))
+}
+
+// matchGlob matches path segments against glob segments, where a "**" segment matches zero or more segments.
+func matchGlob(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchGlob(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	matched, err := path.Match(pattern[0], segments[0])
+	if err != nil || !matched {
+		return false
+	}
+	return matchGlob(pattern[1:], segments[1:])
+}
+
+// validatePatterns checks that every pattern is a valid glob or regular expression.
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if expr, ok := strings.CutPrefix(pattern, regexPrefix); ok {
+			if _, err := regexp.Compile(expr); err != nil {
+				return fmt.Errorf("invalid regular expression %q: %w", pattern, err)
+			}
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Operation is a multi-step git operation that is in progress in a repository.
+type Operation string
+
+// Operations detected from the state files git keeps in the git directory.
+const (
+	// OperationNone means no operation is in progress.
+	OperationNone Operation = ""
+	// OperationRebase is a rebase stopped part way.
+	OperationRebase Operation = "rebase"
+	// OperationAm is a git am session applying patches.
+	OperationAm Operation = "am"
+	// OperationMerge is a merge waiting for its conflicts to be resolved.
+	OperationMerge Operation = "merge"
+	// OperationCherryPick is a cherry-pick stopped part way.
+	OperationCherryPick Operation = "cherry-pick"
+	// OperationRevert is a revert stopped part way.
+	OperationRevert Operation = "revert"
+	// OperationBisect is a bisect session.
+	OperationBisect Operation = "bisect"
+)
+
+// detectOperation returns the operation in progress in the git directory gitDir. A rebase is checked first,
+// as a rebase stopped on a conflict also leaves the state files of the commit it was picking.
+func detectOperation(gitDir string) Operation {
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(gitDir, name))
+		return err == nil
+	}
+	switch {
+	case exists("rebase-merge"):
+		return OperationRebase
+	case exists(filepath.Join("rebase-apply", "applying")):
+		return OperationAm
+	case exists("rebase-apply"):
+		return OperationRebase
+	case exists("MERGE_HEAD"):
+		return OperationMerge
+	case exists("CHERRY_PICK_HEAD"):
+		return OperationCherryPick
+	case exists("REVERT_HEAD"):
+		return OperationRevert
+	case exists("BISECT_LOG"):
+		return OperationBisect
+	}
+	return OperationNone
+}
+
+// abortArgs returns the git arguments that abort the operation.
+func (op Operation) abortArgs() []string {
+	if op == OperationBisect {
+		return []string{"bisect", "reset"}
+	}
+	return []string{string(op), "--abort"}
+}
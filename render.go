@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// renderText writes the human readable report for the results, grouped by repository state.
+func renderText(w io.Writer, results []CheckResult, cfg Config) {
+	sortResults(results)
+
+	var outdated, skipped, failed, upToDate []CheckResult
+	for _, result := range results {
+		switch result.State {
+		case StateUpToDate:
+			upToDate = append(upToDate, result)
+		case StateSkipped:
+			skipped = append(skipped, result)
+		case StateError:
+			failed = append(failed, result)
+		default:
+			outdated = append(outdated, result)
+		}
+	}
+
+	if len(outdated) > 0 {
+		fmt.Fprintln(w, "\nOutdated Repositories:")
+		for _, result := range outdated {
+			fmt.Fprintln(w, formatResult(result, cfg))
+		}
+	}
+
+	fmt.Fprintln(w)
+
+	renderSection(w, "Skipped Repositories", skipped, cfg)
+	renderSection(w, "Failed Repositories", failed, cfg)
+	renderSection(w, "Up-to-Date Repositories", upToDate, cfg)
+	renderHosts(w, summarizeHosts(results))
+}
+
+// renderHosts writes the number of repositories that failed to reach each remote host, if any.
+func renderHosts(w io.Writer, hosts []HostSummary) {
+	if len(hosts) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Unreachable Remote Hosts:\n\n")
+	for _, host := range hosts {
+		text := fmt.Sprintf("%s: %s failed", host.Host, repositoryCount(host.Failed))
+		if host.CircuitOpen > 0 {
+			text += fmt.Sprintf(", %s not tried (circuit open)", repositoryCount(host.CircuitOpen))
+		}
+		fmt.Fprintf(w, "%s%s%s\n", LightRed, text, Reset)
+	}
+	fmt.Fprintln(w)
+}
+
+// repositoryCount formats a number of repositories, e.g. "1 repository" or "3 repositories".
+func repositoryCount(n int) string {
+	if n == 1 {
+		return "1 repository"
+	}
+	return fmt.Sprintf("%d repositories", n)
+}
+
+// renderSection writes a titled list of results, if there are any.
+func renderSection(w io.Writer, title string, results []CheckResult, cfg Config) {
+	if len(results) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s:\n\n", title)
+	for _, result := range results {
+		fmt.Fprintln(w, formatResult(result, cfg))
+	}
+	fmt.Fprintln(w)
+}
+
+// formatResult formats a single result as colored text. The remote branch is shown next to the repository
+// name when it differs from the one in cfg, e.g. when it was resolved automatically or overridden.
+func formatResult(result CheckResult, cfg Config) string {
+	if result.Remote != cfg.RemoteName || result.Branch != cfg.Branch {
+		result.RepoName = fmt.Sprintf("%s (%s/%s)", result.RepoName, result.Remote, result.Branch)
+	}
+
+	switch result.State {
+	case StateUpToDate:
+		return fmt.Sprintf("%s%s is up-to-date%s%s", LightGreen, result.RepoName, dirtyMarker(result.Status), Reset)
+	case StateSkipped:
+		return result.Err.Error()
+	case StateError:
+		details := gitErrorDetails(result.Err, cfg)
+		if result.Ahead == 0 && result.Behind == 0 {
+			return fmt.Sprintf("%s%v%s%s", LightRed, result.Err, details, Reset)
+		}
+		return fmt.Sprintf("%s\n%s%v%s%s", formatOutdated(result), LightRed, result.Err, details, Reset)
+	default:
+		return formatOutdated(result)
+	}
+}
+
+// formatOutdated formats the sync state, last commit and actions taken for an outdated repository.
+func formatOutdated(result CheckResult) string {
+	var text string
+	switch {
+	case result.Ahead > 0 && result.Behind > 0:
+		params := []any{LightRed, result.RepoName, result.Ahead, commitText(result.Ahead), result.Behind}
+		text = fmt.Sprintf("%s\n%s has diverged, %d %s ahead and %d behind", params...)
+	case result.Ahead > 0:
+		text = fmt.Sprintf("%s\n%s is %d %s ahead", LightRed, result.RepoName, result.Ahead, commitText(result.Ahead))
+	default:
+		text = fmt.Sprintf("%s\n%s is %d %s behind", LightRed, result.RepoName, result.Behind, commitText(result.Behind))
+	}
+	text += dirtyMarker(result.Status)
+	if c := result.LastCommit; c != nil {
+		text += fmt.Sprintf("\nLast commit by %s %s\n%s %s", c.Author, commitDate(c.Date), c.ShortHash, c.Subject)
+	}
+	text += Reset
+
+	if len(result.Actions) > 0 {
+		text += "\n:."
+		if result.DryRun {
+			text += " (dry run)"
+		}
+		for _, action := range result.Actions {
+			text += "\n " + action
+		}
+	}
+	if result.Updated {
+		text += fmt.Sprintf("\n%s %s is up-to-date%s", LightGreen, result.RepoName, Reset)
+	}
+	return text
+}
+
+// dirtyMarker describes the local changes in a working tree, or returns an empty string for a clean tree.
+func dirtyMarker(status StatusCounts) string {
+	if !status.IsDirty() {
+		return ""
+	}
+	var parts []string
+	for _, count := range []struct {
+		n    int
+		kind string
+	}{
+		{status.Staged, "staged"},
+		{status.Unstaged, "unstaged"},
+		{status.Untracked, "untracked"},
+		{status.Conflicted, "conflicted"},
+	} {
+		if count.n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count.n, count.kind))
+		}
+	}
+	return fmt.Sprintf(" (dirty: %s)", strings.Join(parts, ", "))
+}
+
+// sortResults orders results by repository path so reports are stable between runs.
+func sortResults(results []CheckResult) {
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Path < results[j].Path
+	})
+}
+
+// jsonReport is the document written by renderJSON.
+type jsonReport struct {
+	Remote       string           `json:"remote"`
+	Branch       string           `json:"branch"`
+	Repositories []jsonRepository `json:"repositories"`
+	Hosts        []HostSummary    `json:"unreachable_hosts,omitempty"`
+}
+
+// jsonRepository describes a single repository in the JSON report.
+type jsonRepository struct {
+	Name       string        `json:"name"`
+	Path       string        `json:"path"`
+	Remote     string        `json:"remote"`
+	RemoteURL  string        `json:"remote_url,omitempty"`
+	Branch     string        `json:"branch"`
+	State      string        `json:"state"`
+	Ahead      int           `json:"ahead"`
+	Behind     int           `json:"behind"`
+	Dirty      bool          `json:"dirty"`
+	Status     StatusCounts  `json:"status"`
+	LastCommit *Commit       `json:"last_commit,omitempty"`
+	Actions    []string      `json:"actions"`
+	DryRun     bool          `json:"dry_run"`
+	Updated    bool          `json:"updated"`
+	Error      string        `json:"error,omitempty"`
+	GitError   *jsonGitError `json:"git_error,omitempty"`
+}
+
+// jsonGitError is the JSON representation of the git command that caused the error of a repository.
+type jsonGitError struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
+	Stderr   string `json:"stderr"`
+}
+
+// renderJSON writes a single JSON document describing every result.
+func renderJSON(w io.Writer, results []CheckResult, cfg Config) error {
+	sortResults(results)
+
+	report := jsonReport{
+		Remote:       cfg.RemoteName,
+		Branch:       cfg.Branch,
+		Repositories: make([]jsonRepository, 0, len(results)),
+		Hosts:        summarizeHosts(results),
+	}
+	for _, result := range results {
+		repo := jsonRepository{
+			Name:       result.RepoName,
+			Path:       result.Path,
+			Remote:     result.Remote,
+			RemoteURL:  result.RemoteURL,
+			Branch:     result.Branch,
+			State:      result.State.String(),
+			Ahead:      result.Ahead,
+			Behind:     result.Behind,
+			Dirty:      result.Status.IsDirty(),
+			Status:     result.Status,
+			LastCommit: result.LastCommit,
+			Actions:    result.Actions,
+			DryRun:     result.DryRun,
+			Updated:    result.Updated,
+		}
+		if repo.Actions == nil {
+			repo.Actions = []string{}
+		}
+		if result.Err != nil {
+			repo.Error = result.Err.Error()
+		}
+		var gitErr *GitError
+		if errors.As(result.Err, &gitErr) {
+			repo.GitError = &jsonGitError{Command: gitErr.Command(), ExitCode: gitErr.ExitCode, Stderr: gitErr.Stderr}
+		}
+		report.Repositories = append(report.Repositories, repo)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// commitDate formats the ISO 8601 date of a commit the way git log shows it. Dates that cannot be parsed are
+// shown as they are.
+func commitDate(date string) string {
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return date
+	}
+	return t.Format(GitDateLayout)
+}
@@ -11,7 +11,7 @@
 
 // Optionally, reporter can also automatically update repositories that are behind. If necessary,
 // reporter will stash local changes, before pulling the latest updates, and then reapply
-// the stashed changes.
+// the stashed changes. Untracked files are only stashed when stash_untracked is set.
 
 // It is possible to configure reporter by creating an .rprc file. Place this file wherever
 // you'd like to run reporter.
@@ -26,16 +26,47 @@
 //		exclude:
 //		- repo3
 //		remote_name: origin
+//		max_depth: 3
+//		output: text
+//		update_strategy: ff-only
+//		stash_untracked: false
+//		jobs: 8
+//		timeout: 5m
+//		command_timeout: 2m
+//		retry:
+//		  attempts: 5
+//		  base_delay: 100ms
+//		  max_delay: 5s
+//		manifest:
+//		- path: backend/api
+//		  url: git@github.com:acme/api.git
+//		  branch: main
+//		groups:
+//		  backend:
+//		  - api
+//		  - worker
+//		repos:
+//		  trunk-based-*:
+//		    branch: auto
+//		  legacy-service:
+//		    branch: master
+//		  forks/*:
+//		    remote_name: upstream
+//		    update: false
 //	```
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -47,12 +78,38 @@ func main() {
 	branchShort := flag.String("b", "main", "Specify the branch to check (short)")
 	log := flag.Bool("log", false, "Show the complete list of changes using git log")
 	logShort := flag.Bool("l", false, "Show the complete list of changes using git log (short)")
-	force := flag.Bool("force", false, "Forcefully abort rebase and merge conflicts to update")
-	forceShort := flag.Bool("f", false, "Forcefully abort rebase and merge conflicts to update (short)")
+	force := flag.Bool("force", false, "Abort a rebase, merge or other git operation in progress to update")
+	forceShort := flag.Bool("f", false, "Abort a rebase, merge or other git operation in progress to update (short)")
 	remote := flag.String("remote", "origin", "Specify the remote name")
 	remoteShort := flag.String("r", "origin", "Specify the remote name (short)")
+	depth := flag.Int("depth", DefaultMaxDepth, "Maximum directory depth searched for repositories")
+	dryRun := flag.Bool("dry-run", false, "Show the actions an update would take without changing repositories")
+	dryRunShort := flag.Bool("n", false, "Show the actions an update would take without changing repositories (short)")
+	strategy := flag.String("strategy", StrategyFFOnly, "Update strategy: ff-only, rebase or merge")
+	strategyShort := flag.String("s", StrategyFFOnly, "Update strategy: ff-only, rebase or merge (short)")
+	stashUntracked := flag.Bool("stash-untracked", false, "Also stash untracked files before updating")
+	jobs := flag.Int("jobs", 0, "Number of repositories checked concurrently")
+	jobsShort := flag.Int("j", 0, "Number of repositories checked concurrently (short)")
+	timeout := flag.Duration("timeout", 0, "Maximum duration of the whole run, e.g. 5m")
+	commandTimeout := flag.Duration("command-timeout", DefaultCommandTimeout, "Maximum duration of a single git command")
+	output := flag.String("output", OutputText, "Output format: text or json")
+	outputShort := flag.String("o", OutputText, "Output format: text or json (short)")
+	verbose := flag.Bool("verbose", false, "Show the full output of failed git commands")
+	verboseShort := flag.Bool("v", false, "Show the full output of failed git commands (short)")
 
-	flag.Parse()
+	var includeFlag, excludeFlag stringList
+	flag.Var(&includeFlag, "include", "Include repositories matching a name, glob or re: regular expression")
+	flag.Var(&excludeFlag, "exclude", "Exclude repositories matching a name, glob or re: regular expression")
+	var groupFlag stringList
+	flag.Var(&groupFlag, "group", "Only use repositories in the named group from .rprc")
+	flag.Var(&groupFlag, "g", "Only use repositories in the named group from .rprc (short)")
+
+	// A leading argument that is not a flag selects a command, e.g. rp sync -u.
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	positional := parseInterspersed(flag.CommandLine, args)
 
 	if *help || *helpShort {
 		showUsage()
@@ -61,12 +118,22 @@ func main() {
 
 	// Default configuration
 	config := Config{
-		Branch:     "main",
-		Update:     false,
-		Include:    []string{},
-		Exclude:    []string{},
-		Force:      false,
-		RemoteName: "origin",
+		Branch:         "main",
+		Update:         false,
+		Include:        []string{},
+		Exclude:        []string{},
+		Force:          false,
+		RemoteName:     "origin",
+		MaxDepth:       DefaultMaxDepth,
+		Output:         OutputText,
+		Strategy:       StrategyFFOnly,
+		Jobs:           defaultJobs(),
+		CommandTimeout: DefaultCommandTimeout,
+		Retry: RetryConfig{
+			Attempts:  MaxAttempts,
+			BaseDelay: DefaultRetryBaseDelay,
+			MaxDelay:  DefaultRetryMaxDelay,
+		},
 	}
 
 	currentDir, err := os.Getwd()
@@ -78,9 +145,10 @@ func main() {
 	// Load configuration from .rprc if present
 	configPath, err := findConfigFile(currentDir)
 	if err == nil && configPath != "" {
+		config.ConfigDir = filepath.Dir(configPath)
 		loadedConfig, lErr := loadConfig(configPath)
 		if lErr != nil {
-			fmt.Printf("%sError loading config: %v%s\n", LightRed, err, Reset)
+			fmt.Printf("%sError loading config: %v%s\n", LightRed, lErr, Reset)
 			os.Exit(1)
 		}
 		if loadedConfig.Branch != "" {
@@ -93,6 +161,35 @@ func main() {
 			config.RemoteName = loadedConfig.RemoteName
 		}
 		config.Force = loadedConfig.Force
+		if loadedConfig.MaxDepth != 0 {
+			config.MaxDepth = loadedConfig.MaxDepth
+		}
+		if loadedConfig.Output != "" {
+			config.Output = loadedConfig.Output
+		}
+		if loadedConfig.Strategy != "" {
+			config.Strategy = loadedConfig.Strategy
+		}
+		config.StashUntracked = loadedConfig.StashUntracked
+		if loadedConfig.Jobs > 0 {
+			config.Jobs = loadedConfig.Jobs
+		}
+		config.Timeout = loadedConfig.Timeout
+		config.Repos = loadedConfig.Repos
+		config.Groups = loadedConfig.Groups
+		config.Manifest = loadedConfig.Manifest
+		if loadedConfig.CommandTimeout > 0 {
+			config.CommandTimeout = loadedConfig.CommandTimeout
+		}
+		if loadedConfig.Retry.Attempts > 0 {
+			config.Retry.Attempts = loadedConfig.Retry.Attempts
+		}
+		if loadedConfig.Retry.BaseDelay > 0 {
+			config.Retry.BaseDelay = loadedConfig.Retry.BaseDelay
+		}
+		if loadedConfig.Retry.MaxDelay > 0 {
+			config.Retry.MaxDelay = loadedConfig.Retry.MaxDelay
+		}
 	}
 
 	// Override config with command line flags
@@ -124,93 +221,254 @@ func main() {
 		config.RemoteName = *remoteShort
 	}
 
-	if *log || *logShort {
-		if !isGitRepository(currentDir) {
-			fmt.Printf("%sError: %s is not a Git repository%s\n", LightRed, currentDir, Reset)
+	if *depth != DefaultMaxDepth {
+		config.MaxDepth = *depth
+	}
+
+	// A dry run plans the update.
+	if *dryRun || *dryRunShort {
+		config.DryRun = true
+		config.Update = true
+	}
+
+	if *verbose || *verboseShort {
+		config.Verbose = true
+	}
+
+	if *strategy != StrategyFFOnly {
+		config.Strategy = *strategy
+	}
+	if *strategyShort != StrategyFFOnly {
+		config.Strategy = *strategyShort
+	}
+	if !isValidStrategy(config.Strategy) {
+		fmt.Printf("%sError unsupported update strategy: %s%s\n", LightRed, config.Strategy, Reset)
+		os.Exit(1)
+	}
+	for name, repo := range config.Repos {
+		if repo.Strategy != "" && !isValidStrategy(repo.Strategy) {
+			fmt.Printf("%sError unsupported update strategy for %s: %s%s\n", LightRed, name, repo.Strategy, Reset)
 			os.Exit(1)
 		}
-		if rErr := runGitLog(currentDir, config.RemoteName, config.Branch); err != nil {
-			fmt.Printf("%sError running git log: %v%s\n", LightRed, rErr, Reset)
-			os.Exit(1)
+	}
+
+	if *stashUntracked {
+		config.StashUntracked = *stashUntracked
+	}
+
+	// Unlike the other flags, --jobs 0 is rejected rather than treated as unset.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "jobs":
+			config.Jobs = *jobs
+		case "j":
+			config.Jobs = *jobsShort
 		}
-		return
+	})
+	if jErr := validateJobs(config.Jobs); jErr != nil {
+		fmt.Printf("%sError %v%s\n", LightRed, jErr, Reset)
+		os.Exit(1)
 	}
 
-	if isGitRepository(currentDir) {
-		repoName := filepath.Base(currentDir)
-		if isIncluded(repoName, config.Include, config.Exclude) {
-			var wg sync.WaitGroup
-			results := make(chan string, 1)
-			wg.Add(1)
-			fmt.Printf("\nChecking Repository For Updates. git: (%s/%s)\n", config.RemoteName, config.Branch)
-			checkIfBehind(currentDir, &wg, results, config)
-			wg.Wait()
-			close(results)
+	if *timeout > 0 {
+		config.Timeout = *timeout
+	}
+	if *commandTimeout != DefaultCommandTimeout {
+		config.CommandTimeout = *commandTimeout
+	}
 
-			for result := range results {
-				fmt.Println(result)
-			}
-			fmt.Println()
+	if *output != OutputText {
+		config.Output = *output
+	}
+	if *outputShort != OutputText {
+		config.Output = *outputShort
+	}
+	if config.Output != OutputText && config.Output != OutputJSON {
+		fmt.Printf("%sError unsupported output format: %s%s\n", LightRed, config.Output, Reset)
+		os.Exit(1)
+	}
+
+	config.Include = append(config.Include, includeFlag...)
+	config.Exclude = append(config.Exclude, excludeFlag...)
+	for _, patterns := range [][]string{config.Include, config.Exclude} {
+		if pErr := validatePatterns(patterns); pErr != nil {
+			fmt.Printf("%sError %v%s\n", LightRed, pErr, Reset)
+			os.Exit(1)
 		}
-		return
 	}
 
-	fmt.Printf("\nChecking Repositories For Updates. git: (%s/%s)\n", config.RemoteName, config.Branch)
+	config.SelectedGroups = groupFlag
+	for _, group := range config.SelectedGroups {
+		members, ok := config.Groups[group]
+		if !ok {
+			fmt.Printf("%sError unknown group: %s%s\n", LightRed, group, Reset)
+			os.Exit(1)
+		}
+		if pErr := validatePatterns(members); pErr != nil {
+			fmt.Printf("%sError %v%s\n", LightRed, pErr, Reset)
+			os.Exit(1)
+		}
+	}
+
+	config.Root = currentDir
+	config.Started = time.Now()
+	config.RunID = newRunID(config.Started)
+
+	// Ctrl-C or the global timeout cancels the run; repositories being updated are restored before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
 
-	files, err := os.ReadDir(currentDir)
+	switch command {
+	case "":
+		err = runCheck(ctx, config, *log || *logShort)
+	case "sync":
+		err = runSync(ctx, config)
+	case "freeze":
+		err = runFreeze(ctx, config)
+	case "thaw":
+		err = runThaw(ctx, config, positional)
+	case "stash":
+		err = runStash(ctx, config, positional)
+	case "undo":
+		err = runUndo(ctx, config, positional)
+	default:
+		err = fmt.Errorf("unknown command: %s", command)
+	}
 	if err != nil {
-		fmt.Printf("%sError reading current directory: %v%s\n", LightRed, err, Reset)
+		// Errors go to stderr so they never mix with a JSON report on stdout.
+		fmt.Fprintf(os.Stderr, "%sError %v%s\n", LightRed, err, Reset)
+		stop()
 		os.Exit(1)
 	}
+}
 
-	var wg sync.WaitGroup
-	results := make(chan string, len(files))
+// parseInterspersed parses the flags in args, which may appear before, between or after the arguments of a
+// command, e.g. rp stash list -o json, and returns the arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		_ = fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
 
-	for _, file := range files {
-		if file.IsDir() {
-			dirPath := filepath.Join(currentDir, file.Name())
-			if isGitRepository(dirPath) {
-				repoName := filepath.Base(dirPath)
-				if isIncluded(repoName, config.Include, config.Exclude) {
-					wg.Add(1)
-					go checkIfBehind(dirPath, &wg, results, config)
-				}
-			}
+// selectRepositories returns the selected repositories below the root, or only the root when it is itself a
+// repository, and whether the root is a repository.
+func selectRepositories(cfg Config) (repos []string, singleRepo bool, err error) {
+	// When run inside a repository only that repository is checked.
+	singleRepo = isGitRepository(cfg.Root)
+	found := []string{cfg.Root}
+	if !singleRepo {
+		found, err = findRepositories(cfg.Root, cfg.MaxDepth)
+		if err != nil {
+			return nil, false, fmt.Errorf("searching for repositories: %w", err)
+		}
+	}
+
+	for _, dirPath := range found {
+		if cfg.isSelected(dirPath) {
+			repos = append(repos, dirPath)
 		}
 	}
+	return repos, singleRepo, nil
+}
 
-	wg.Wait()
-	close(results)
+// runCheck checks, and optionally updates, the selected repositories and reports the results,
+// or shows the incoming changes of each repository when showLog is set.
+func runCheck(ctx context.Context, cfg Config, showLog bool) error {
+	repos, singleRepo, err := selectRepositories(cfg)
+	if err != nil {
+		return err
+	}
 
-	var outdatedRepos []string
-	var upToDateRepos []string
+	if showLog {
+		if lErr := showLogs(ctx, repos, cfg, singleRepo); lErr != nil {
+			return fmt.Errorf("running git log: %w", lErr)
+		}
+		return nil
+	}
+	return reportRepositories(ctx, cfg, repos, singleRepo)
+}
 
-	// Separate results into two stacks.
-	for result := range results {
-		if strings.Contains(result, LightRed) {
-			outdatedRepos = append(outdatedRepos, result)
-		} else if strings.Contains(result, LightGreen) {
-			upToDateRepos = append(upToDateRepos, result)
-		} else {
-			fmt.Println(result)
+// reportRepositories checks, and optionally updates, the repositories and reports the results.
+func reportRepositories(ctx context.Context, cfg Config, repos []string, singleRepo bool) error {
+	// Repositories are journaled before they are changed, whether the run or an override of the repository
+	// updates them.
+	if !cfg.DryRun {
+		cfg.Journal = newRunJournal(cfg)
+	}
+	if cfg.Output == OutputJSON {
+		results := checkRepositories(ctx, repos, cfg)
+		reportUndo(cfg)
+		if rErr := renderJSON(os.Stdout, results, cfg); rErr != nil {
+			return fmt.Errorf("writing JSON output: %w", rErr)
 		}
+		return incompleteRun(ctx)
 	}
 
-	// Report results.
-	if len(outdatedRepos) > 0 {
-		fmt.Println("\nOutdated Repositories:")
-		for _, repo := range outdatedRepos {
-			fmt.Println(repo)
+	if singleRepo {
+		if len(repos) == 0 {
+			return nil
+		}
+		fmt.Printf("\nChecking Repository For Updates. git: (%s/%s)\n", cfg.RemoteName, cfg.Branch)
+		results := checkRepositories(ctx, repos, cfg)
+		for _, result := range results {
+			fmt.Println(formatResult(result, cfg))
 		}
+		fmt.Println()
+		reportUndo(cfg)
+		return incompleteRun(ctx)
 	}
 
-	fmt.Println()
+	fmt.Printf("\nChecking Repositories For Updates. git: (%s/%s)\n", cfg.RemoteName, cfg.Branch)
 
-	if len(upToDateRepos) > 0 {
-		fmt.Printf("Up-to-Date Repositories:\n\n")
-		for _, repo := range upToDateRepos {
-			fmt.Println(repo)
+	// Report results.
+	results := checkRepositories(ctx, repos, cfg)
+	renderText(os.Stdout, results, cfg)
+	reportUndo(cfg)
+	return incompleteRun(ctx)
+}
+
+// incompleteRun returns an error when the run was interrupted or timed out, so the exit code tells scripts
+// that repositories were skipped or rolled back.
+func incompleteRun(ctx context.Context) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return errors.New("run timed out, repositories were skipped or rolled back")
+	case ctx.Err() != nil:
+		return errors.New("run interrupted, repositories were skipped or rolled back")
+	}
+	return nil
+}
+
+// showLogs shows the changes on the remote branch missing locally. A single repository is shown in the pager,
+// several repositories are shown one after the other under a heading with the repository path.
+func showLogs(ctx context.Context, repos []string, cfg Config, singleRepo bool) error {
+	for _, dir := range repos {
+		repoConfig := cfg.forRepo(dir)
+		if repoConfig.Branch == BranchAuto {
+			g := NewGitExecutor(repoConfig, dir, filepath.Base(dir))
+			branch, err := g.defaultBranch(ctx)
+			if err != nil {
+				return fmt.Errorf("detecting default branch of %s: %w", dir, err)
+			}
+			repoConfig.Branch = branch
+		}
+		if !singleRepo {
+			fmt.Printf("\n%s (%s/%s)\n\n", relativePath(cfg.Root, dir), repoConfig.RemoteName, repoConfig.Branch)
+		}
+		if err := runGitLog(dir, repoConfig.RemoteName, repoConfig.Branch, singleRepo); err != nil {
+			return err
 		}
 	}
-	fmt.Println()
+	return nil
 }
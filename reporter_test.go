@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/sony/gobreaker"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -43,7 +53,7 @@ func TestGetGitRoot(t *testing.T) {
 	cleanup := setupTestRepo(t, tempDir)
 	defer cleanup()
 
-	gitRoot, err := getGitRoot(tempDir)
+	gitRoot, err := getGitRoot(context.Background(), execRunner{}, tempDir)
 	assert.NoError(t, err, "Expected no error when getting git root")
 
 	// Get the absolute and cleaned paths.
@@ -177,32 +187,1186 @@ func TestValidateKeys(t *testing.T) {
 	assert.Contains(t, err.Error(), "Error unsupported key in config file: invalid_key", "Expected error message to contain 'invalid_key'")
 }
 
+func TestRepoOverrides(t *testing.T) {
+	// Define a temporary directory for the config file.
+	tempDir := filepath.Join("..", "test_repo_overrides")
+	err := os.MkdirAll(tempDir, 0755)
+	assert.NoError(t, err, "Failed to create temp dir for test config")
+	defer os.RemoveAll(tempDir)
+
+	configPath := filepath.Join(tempDir, ".rprc")
+	configContent := `
+branch: main
+repos:
+  legacy:
+    branch: master
+  forks/*:
+    remote_name: upstream
+    update: false
+  forks/special:
+    update_strategy: rebase
+`
+	err = os.WriteFile(configPath, []byte(configContent), 0644)
+	assert.NoError(t, err, "Failed to write test config file")
+
+	config, err := loadConfig(configPath)
+	assert.NoError(t, err, "Expected no error when loading config")
+	config.Root = "/work"
+	config.Update = true
+	config.RemoteName = "origin"
+	config.Strategy = StrategyFFOnly
+
+	// Overrides by repository name.
+	legacy := config.forRepo("/work/team/legacy")
+	assert.Equal(t, "master", legacy.Branch, "Expected legacy branch to be 'master'")
+	assert.Equal(t, "origin", legacy.RemoteName, "Expected legacy remote to be unchanged")
+	assert.True(t, legacy.Update, "Expected legacy update to be unchanged")
+
+	// Overrides by path glob are merged in order.
+	special := config.forRepo("/work/forks/special")
+	assert.Equal(t, "main", special.Branch, "Expected special branch to be unchanged")
+	assert.Equal(t, "upstream", special.RemoteName, "Expected special remote to be 'upstream'")
+	assert.False(t, special.Update, "Expected special update to be false")
+	assert.Equal(t, StrategyRebase, special.Strategy, "Expected special strategy to be 'rebase'")
+
+	// Repositories without overrides use the global configuration.
+	other := config.forRepo("/work/team/other")
+	assert.Equal(t, "main", other.Branch, "Expected other branch to be 'main'")
+	assert.True(t, other.Update, "Expected other update to be true")
+
+	// Unsupported keys in overrides are rejected.
+	err = os.WriteFile(configPath, []byte("repos:\n  legacy:\n    brnach: master\n"), 0644)
+	assert.NoError(t, err, "Failed to write test config file")
+	_, err = loadConfig(configPath)
+	assert.Error(t, err, "Expected error with an invalid override key")
+}
+
+func TestLoadManifest(t *testing.T) {
+	// Define a temporary directory for the config file.
+	tempDir := filepath.Join("..", "test_manifest")
+	err := os.MkdirAll(tempDir, 0755)
+	assert.NoError(t, err, "Failed to create temp dir for test config")
+	defer os.RemoveAll(tempDir)
+
+	configPath := filepath.Join(tempDir, ".rprc")
+	configContent := `
+manifest:
+  - path: backend/api
+    url: git@github.com:acme/api.git
+    branch: develop
+  - path: frontend/web
+    url: git@github.com:acme/web.git
+`
+	err = os.WriteFile(configPath, []byte(configContent), 0644)
+	assert.NoError(t, err, "Failed to write test config file")
+
+	config, err := loadConfig(configPath)
+	assert.NoError(t, err, "Expected no error when loading config")
+	assert.Len(t, config.Manifest, 2, "Expected two manifest entries")
+	assert.Equal(t, "git@github.com:acme/api.git", config.Manifest[0].URL, "Expected manifest url to match")
+
+	// Manifest paths are relative to the config file and set the branch checked.
+	config.ConfigDir = tempDir
+	config.Branch = "main"
+	apiPath := config.manifestPath(config.Manifest[0])
+	assert.Equal(t, filepath.Join(tempDir, "backend", "api"), apiPath, "Expected manifest path to match")
+	assert.Equal(t, "develop", config.forRepo(apiPath).Branch, "Expected manifest branch to be used")
+	webPath := config.manifestPath(config.Manifest[1])
+	assert.Equal(t, "main", config.forRepo(webPath).Branch, "Expected global branch without manifest branch")
+
+	// Entries require a url.
+	err = os.WriteFile(configPath, []byte("manifest:\n  - path: backend/api\n"), 0644)
+	assert.NoError(t, err, "Failed to write test config file")
+	_, err = loadConfig(configPath)
+	assert.Error(t, err, "Expected error for manifest entry without url")
+}
+
+func TestLoadLock(t *testing.T) {
+	// Define a temporary directory for the lock file.
+	tempDir := filepath.Join("..", "test_lock")
+	err := os.MkdirAll(tempDir, 0755)
+	assert.NoError(t, err, "Failed to create temp dir for test lock")
+	defer os.RemoveAll(tempDir)
+
+	lockPath := filepath.Join(tempDir, "workspace.lock")
+	lockContent := `
+repositories:
+  - path: backend/api
+    branch: main
+    commit: 2743ff76bbdc4affba6b39a8866fd7ccb8db8190
+    remote_url: git@github.com:acme/api.git
+`
+	err = os.WriteFile(lockPath, []byte(lockContent), 0644)
+	assert.NoError(t, err, "Failed to write test lock file")
+
+	lock, err := loadLock(lockPath)
+	assert.NoError(t, err, "Expected no error when loading lock file")
+	assert.Equal(t, []LockEntry{{
+		Path:      "backend/api",
+		Branch:    "main",
+		Commit:    "2743ff76bbdc4affba6b39a8866fd7ccb8db8190",
+		RemoteURL: "git@github.com:acme/api.git",
+	}}, lock.Repositories, "Expected lock entries to match")
+
+	// Entries require a commit.
+	err = os.WriteFile(lockPath, []byte("repositories:\n  - path: backend/api\n"), 0644)
+	assert.NoError(t, err, "Failed to write test lock file")
+	_, err = loadLock(lockPath)
+	assert.Error(t, err, "Expected error for lock entry without commit")
+
+	// Paths cannot leave the directory thawed.
+	for _, path := range []string{"/etc/api", "../api", "backend/../../api"} {
+		content := fmt.Sprintf("repositories:\n  - path: %s\n    commit: 2743ff7\n", path)
+		err = os.WriteFile(lockPath, []byte(content), 0644)
+		assert.NoError(t, err, "Failed to write test lock file")
+		_, err = loadLock(lockPath)
+		assert.Error(t, err, "Expected error for lock entry path %s", path)
+	}
+}
+
 func TestIsIncluded(t *testing.T) {
 	include := []string{"repo1", "repo2"}
 	exclude := []string{"repo3"}
 
 	// Test inclusion
-	assert.True(t, isIncluded("repo1", include, exclude), "Expected repo1 to be included")
-	assert.True(t, isIncluded("repo2", include, exclude), "Expected repo2 to be included")
+	assert.True(t, isIncluded("repo1", "team/repo1", include, exclude), "Expected repo1 to be included")
+	assert.True(t, isIncluded("repo2", "team/repo2", include, exclude), "Expected repo2 to be included")
 
 	// Test exclusion
-	assert.False(t, isIncluded("repo3", include, exclude), "Expected repo3 to be excluded")
+	assert.False(t, isIncluded("repo3", "team/repo3", include, exclude), "Expected repo3 to be excluded")
 
 	// Test inclusion with empty include list and non-empty exclude list
-	assert.True(t, isIncluded("repo4", []string{}, exclude), "Expected repo4 to be included when include list is empty and not in exclude list")
-	assert.False(t, isIncluded("repo3", []string{}, exclude), "Expected repo3 to be excluded when include list is empty and in exclude list")
+	assert.True(t, isIncluded("repo4", "team/repo4", []string{}, exclude), "Expected repo4 to be included when include list is empty and not in exclude list")
+	assert.False(t, isIncluded("repo3", "team/repo3", []string{}, exclude), "Expected repo3 to be excluded when include list is empty and in exclude list")
 
 	// Test inclusion with empty exclude list and non-empty include list
-	assert.True(t, isIncluded("repo1", include, []string{}), "Expected repo1 to be included when exclude list is empty")
-	assert.False(t, isIncluded("repo4", include, []string{}), "Expected repo4 to be excluded when not in include list and exclude list is empty")
+	assert.True(t, isIncluded("repo1", "team/repo1", include, []string{}), "Expected repo1 to be included when exclude list is empty")
+	assert.False(t, isIncluded("repo4", "team/repo4", include, []string{}), "Expected repo4 to be excluded when not in include list and exclude list is empty")
 
 	// Test inclusion with both include and exclude lists empty
-	assert.True(t, isIncluded("repo5", []string{}, []string{}), "Expected repo5 to be included when both include and exclude lists are empty")
+	assert.True(t, isIncluded("repo5", "team/repo5", []string{}, []string{}), "Expected repo5 to be included when both include and exclude lists are empty")
 
 	// Test inclusion when repo is in both lists
 	includeBoth := []string{"repo1", "repo2", "repo6"}
 	excludeBoth := []string{"repo3", "repo6"}
-	assert.True(t, isIncluded("repo6", includeBoth, excludeBoth), "Expected repo6 to be included when in both include and exclude lists")
+	assert.True(t, isIncluded("repo6", "team/repo6", includeBoth, excludeBoth), "Expected repo6 to be included when in both include and exclude lists")
+}
+
+func TestFindRepositories(t *testing.T) {
+	// Define a temporary workspace laid out as <team>/<service>.
+	tempDir := filepath.Join("..", "test_workspace")
+	defer os.RemoveAll(tempDir)
+
+	dirs := []string{
+		filepath.Join("backend", "api", ".git"),
+		filepath.Join("backend", "api", "nested", ".git"),
+		filepath.Join("backend", "worker", ".git"),
+		filepath.Join("frontend", "node_modules", "pkg", ".git"),
+		filepath.Join("frontend", "apps", "web", ".git"),
+		filepath.Join(".cache", "repo", ".git"),
+	}
+	for _, dir := range dirs {
+		err := os.MkdirAll(filepath.Join(tempDir, dir), 0755)
+		assert.NoError(t, err, "Failed to create test workspace dir %s", dir)
+	}
+
+	// Repositories are found recursively, skipping nested repositories and heavy directories.
+	repos, err := findRepositories(tempDir, -1)
+	assert.NoError(t, err, "Expected no error when searching for repositories")
+	expected := []string{
+		filepath.Join(tempDir, "backend", "api"),
+		filepath.Join(tempDir, "backend", "worker"),
+		filepath.Join(tempDir, "frontend", "apps", "web"),
+	}
+	assert.ElementsMatch(t, expected, repos, "Expected repositories to match")
+
+	// The depth limit stops the search.
+	repos, err = findRepositories(tempDir, 2)
+	assert.NoError(t, err, "Expected no error when searching for repositories")
+	assert.ElementsMatch(t, expected[:2], repos, "Expected repositories within depth 2 to match")
+}
+
+func TestParseSymref(t *testing.T) {
+	output := "ref: refs/heads/trunk\tHEAD\n0123456789abcdef\tHEAD\n"
+	branch, err := parseSymref(output)
+	assert.NoError(t, err, "Expected no error for symbolic HEAD")
+	assert.Equal(t, "trunk", branch, "Expected default branch to be 'trunk'")
+
+	_, err = parseSymref("0123456789abcdef\tHEAD\n")
+	assert.Error(t, err, "Expected error when HEAD is not a symbolic ref")
+}
+
+func TestParseLeftRightCount(t *testing.T) {
+	ahead, behind, err := parseLeftRightCount("2\t5\n")
+	assert.NoError(t, err, "Expected no error for valid rev-list output")
+	assert.Equal(t, 2, ahead, "Expected 2 commits ahead")
+	assert.Equal(t, 5, behind, "Expected 5 commits behind")
+
+	_, _, err = parseLeftRightCount("2")
+	assert.Error(t, err, "Expected error for incomplete rev-list output")
+	_, _, err = parseLeftRightCount("a\tb")
+	assert.Error(t, err, "Expected error for non-numeric rev-list output")
+}
+
+func TestClassifyState(t *testing.T) {
+	assert.Equal(t, StateUpToDate, classifyState(0, 0), "Expected up-to-date when in sync")
+	assert.Equal(t, StateBehind, classifyState(0, 3), "Expected behind when only remote has new commits")
+	assert.Equal(t, StateAhead, classifyState(2, 0), "Expected ahead when only local has new commits")
+	assert.Equal(t, StateDiverged, classifyState(2, 3), "Expected diverged when both have new commits")
+}
+
+func TestRenderJSON(t *testing.T) {
+	results := []CheckResult{
+		{RepoName: "repo2", Path: "/work/repo2", Remote: "origin", Branch: "main", State: StateUpToDate},
+		{
+			RepoName: "repo1",
+			Path:     "/work/repo1",
+			Remote:   "origin",
+			Branch:   "main",
+			State:    StateError,
+			Behind:   2,
+			LastCommit: &Commit{
+				Hash:      "abc123def",
+				ShortHash: "abc123",
+				Author:    "Lois Lane",
+				Date:      "2023-11-24T10:56:42+01:00",
+				Subject:   "fix: db",
+			},
+			Actions: []string{"Pulling latest changes"},
+			Err:     errors.New("Error pulling origin/main in repository repo1"),
+		},
+	}
+
+	var out bytes.Buffer
+	err := renderJSON(&out, results, Config{RemoteName: "origin", Branch: "main"})
+	assert.NoError(t, err, "Expected no error when rendering JSON")
+
+	var report jsonReport
+	err = json.Unmarshal(out.Bytes(), &report)
+	assert.NoError(t, err, "Expected valid JSON output")
+
+	// Repositories are sorted by path.
+	assert.Len(t, report.Repositories, 2, "Expected two repositories")
+	assert.Equal(t, "repo1", report.Repositories[0].Name, "Expected repo1 first")
+	assert.Equal(t, "error", report.Repositories[0].State, "Expected repo1 state to be 'error'")
+	assert.Equal(t, 2, report.Repositories[0].Behind, "Expected repo1 to be 2 commits behind")
+	assert.Equal(t, "abc123def", report.Repositories[0].LastCommit.Hash, "Expected last commit hash to match")
+	assert.Equal(t, "2023-11-24T10:56:42+01:00", report.Repositories[0].LastCommit.Date, "Expected an ISO 8601 date")
+	assert.Contains(t, report.Repositories[0].Error, "Error pulling", "Expected error message to be reported")
+	assert.Equal(t, "up-to-date", report.Repositories[1].State, "Expected repo2 state to be 'up-to-date'")
+	assert.Empty(t, report.Repositories[1].Actions, "Expected no actions for repo2")
+}
+
+func TestCommitDate(t *testing.T) {
+	// Text reports show dates the way git log does, keeping the offset of the author.
+	assert.Equal(t, "Fri Nov 24 10:56:42 2023 +0100", commitDate("2023-11-24T10:56:42+01:00"))
+	assert.Equal(t, "", commitDate(""), "Expected commits without a date to show none")
+}
+
+func TestIsIncludedPatterns(t *testing.T) {
+	// Globs match the repository name.
+	include := []string{"svc-*"}
+	assert.True(t, isIncluded("svc-api", "backend/svc-api", include, nil), "Expected svc-api to match svc-*")
+	assert.False(t, isIncluded("web", "frontend/web", include, nil), "Expected web not to match svc-*")
+
+	// Globs with a slash match the relative path, and ** matches any number of directories.
+	exclude := []string{"**/legacy/*"}
+	assert.False(t, isIncluded("old", "legacy/old", nil, exclude), "Expected legacy/old to be excluded")
+	assert.False(t, isIncluded("old", "team/a/legacy/old", nil, exclude), "Expected team/a/legacy/old to be excluded")
+	assert.True(t, isIncluded("old", "team/old", nil, exclude), "Expected team/old to be included")
+
+	// Regular expressions match the name or the relative path.
+	include = []string{"re:^(api|worker)$", "re:^tools/"}
+	assert.True(t, isIncluded("api", "backend/api", include, nil), "Expected api to match the regular expression")
+	assert.True(t, isIncluded("lint", "tools/lint", include, nil), "Expected tools/lint to match the regular expression")
+	assert.False(t, isIncluded("apis", "backend/apis", include, nil), "Expected apis not to match the regular expression")
+
+	// Invalid patterns are reported.
+	assert.NoError(t, validatePatterns([]string{"svc-*", "re:^a+$"}), "Expected valid patterns")
+	assert.Error(t, validatePatterns([]string{"re:("}), "Expected error for invalid regular expression")
+	assert.Error(t, validatePatterns([]string{"svc-["}), "Expected error for invalid glob")
+}
+
+func TestIsSelected(t *testing.T) {
+	config := Config{
+		Root: "/work",
+		Groups: map[string][]string{
+			"backend":  {"api", "worker", "billing-*"},
+			"frontend": {"web/*"},
+		},
+		Exclude: []string{"billing-legacy"},
+	}
+
+	// Without selected groups every repository passing the include and exclude lists is selected.
+	assert.True(t, config.isSelected("/work/web/admin"), "Expected web/admin to be selected without groups")
+
+	// Only members of the selected groups are selected, refined by the exclude list.
+	config.SelectedGroups = []string{"backend"}
+	assert.True(t, config.isSelected("/work/team/api"), "Expected api to be in backend")
+	assert.True(t, config.isSelected("/work/billing-core"), "Expected billing-core to be in backend")
+	assert.False(t, config.isSelected("/work/billing-legacy"), "Expected billing-legacy to be excluded")
+	assert.False(t, config.isSelected("/work/web/admin"), "Expected web/admin not to be in backend")
+
+	// Several groups can be selected at once.
+	config.SelectedGroups = []string{"backend", "frontend"}
+	assert.True(t, config.isSelected("/work/web/admin"), "Expected web/admin to be in frontend")
+}
+
+func TestParseStatus(t *testing.T) {
+	output := strings.Join([]string{
+		"# branch.oid 1234567890abcdef1234567890abcdef12345678",
+		"# branch.head main",
+		"# branch.upstream origin/main",
+		"# branch.ab +1 -2",
+		"1 .M N... 100644 100644 100644 1111111 1111111 reporter.go",
+		"1 MM N... 100644 100644 100644 1111111 2222222 config with spaces.go",
+		"2 R. N... 100644 100644 100644 1111111 1111111 R100 render.go",
+		"old render.go",
+		"u UU N... 100644 100644 100644 100644 1111111 2222222 3333333 executor.go",
+		"u AA N... 000000 100644 100644 100644 0000000 2222222 3333333 result.go",
+		"u DU N... 100644 000000 100644 100644 1111111 0000000 3333333 constants.go",
+		"? notes.txt",
+		"! build/",
+	}, "\x00") + "\x00"
+
+	status, err := parseStatus(output)
+	assert.NoError(t, err)
+	assert.Equal(t, BranchHeader{
+		OID:      "1234567890abcdef1234567890abcdef12345678",
+		Head:     "main",
+		Upstream: "origin/main",
+		Ahead:    1,
+		Behind:   2,
+	}, status.Branch)
+	assert.Len(t, status.Entries, 8)
+	assert.Equal(t, StatusEntry{Kind: EntryOrdinary, XY: "MM", Path: "config with spaces.go"}, status.Entries[1])
+	assert.Equal(t, StatusEntry{Kind: EntryRenamed, XY: "R.", Path: "render.go", OrigPath: "old render.go"},
+		status.Entries[2])
+	assert.Equal(t, StatusEntry{Kind: EntryUnmerged, XY: "DU", Path: "constants.go"}, status.Entries[5])
+	assert.Equal(t, StatusEntry{Kind: EntryIgnored, XY: "!!", Path: "build/"}, status.Entries[7])
+	assert.Equal(t, StatusCounts{Staged: 2, Unstaged: 2, Untracked: 1, Conflicted: 3}, status.counts())
+
+	assert.True(t, status.hasConflicts(), "Expected conflicts")
+
+	clean, err := parseStatus("# branch.oid (initial)\x00# branch.head main\x00")
+	assert.NoError(t, err)
+	assert.False(t, clean.counts().IsDirty(), "Expected a clean working tree")
+	assert.False(t, clean.hasConflicts(), "Expected no conflicts")
+
+	_, err = parseStatus("1 .M N... reporter.go\x00")
+	assert.Error(t, err, "Expected an error for a malformed entry")
+}
+
+func TestDetectOperation(t *testing.T) {
+	gitDir := filepath.Join("..", "test_git_dir")
+	defer os.RemoveAll(gitDir)
+
+	tests := []struct {
+		files    []string
+		expected Operation
+	}{
+		{nil, OperationNone},
+		{[]string{"rebase-merge/"}, OperationRebase},
+		{[]string{"rebase-apply/"}, OperationRebase},
+		{[]string{"rebase-apply/", "rebase-apply/applying"}, OperationAm},
+		{[]string{"MERGE_HEAD"}, OperationMerge},
+		{[]string{"CHERRY_PICK_HEAD"}, OperationCherryPick},
+		{[]string{"REVERT_HEAD"}, OperationRevert},
+		{[]string{"BISECT_LOG"}, OperationBisect},
+		{[]string{"rebase-merge/", "CHERRY_PICK_HEAD"}, OperationRebase},
+	}
+
+	for _, test := range tests {
+		assert.NoError(t, os.RemoveAll(gitDir))
+		assert.NoError(t, os.MkdirAll(gitDir, 0o750))
+		for _, file := range test.files {
+			name := filepath.Join(gitDir, filepath.FromSlash(file))
+			if strings.HasSuffix(file, "/") {
+				assert.NoError(t, os.MkdirAll(name, 0o750))
+				continue
+			}
+			assert.NoError(t, os.WriteFile(name, nil, 0o600))
+		}
+		assert.Equal(t, test.expected, detectOperation(gitDir), "Unexpected operation for %v", test.files)
+	}
+}
+
+func TestStashMessage(t *testing.T) {
+	at := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	runID := newRunID(at)
+	assert.Regexp(t, `^20240301T093000-[0-9a-f]{8}$`, runID)
+	assert.NotEqual(t, runID, newRunID(at), "Expected unique run ids")
+
+	parsedID, parsedAt, ok := parseStashMessage("On main: " + stashMessage(runID, at))
+	assert.True(t, ok, "Expected a reporter stash")
+	assert.Equal(t, runID, parsedID)
+	assert.True(t, at.Equal(parsedAt), "Expected the stash time to round trip")
+
+	_, _, ok = parseStashMessage("On main: Stashed by reporter")
+	assert.False(t, ok, "Expected stashes without a run id to be ignored")
+	_, _, ok = parseStashMessage("WIP on main: 1234567 work in progress")
+	assert.False(t, ok, "Expected other stashes to be ignored")
+}
+
+func TestRenderStashes(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	stashes := []ReporterStash{
+		{
+			RepoName: "api",
+			Path:     "/work/team/api",
+			Branch:   stashBranch("On main: " + stashMessage("run-1", now)),
+			Commit:   "1234567890abcdef",
+			Created:  now.Add(-3 * time.Hour),
+			Files:    []string{"go.mod", "main.go"},
+		},
+		{
+			RepoName: "web",
+			Path:     "/work/web",
+			Branch:   stashBranch("On feature/login: " + stashMessage("run-2", now)),
+			Commit:   "abcdef1234567890",
+			Created:  now.Add(-72 * time.Hour),
+			Files:    []string{"index.html"},
+		},
+	}
+
+	var out bytes.Buffer
+	renderStashes(&out, stashes, Config{Root: "/work"}, now)
+	assert.Contains(t, out.String(), "team/api    main           3h ago  2      1234567")
+	assert.Contains(t, out.String(), "web         feature/login  3d ago  1      abcdef1")
+
+	out.Reset()
+	renderStashes(&out, nil, Config{Root: "/work"}, now)
+	assert.Equal(t, "No reporter stashes found\n", out.String())
+}
+
+func TestJournal(t *testing.T) {
+	stateHome := filepath.Join("..", "test_journal")
+	defer os.RemoveAll(stateHome)
+	t.Setenv("XDG_STATE_HOME", stateHome)
+	dir := filepath.Join(stateHome, "reporter", "runs")
+
+	_, err := loadJournal(dir, "")
+	assert.Error(t, err, "Expected an error without journals")
+
+	// Nothing is written until a repository is changed.
+	journal := newRunJournal(Config{RunID: "20240301T093000-00000001"})
+	assert.False(t, journal.written())
+	_, err = loadJournal(dir, "")
+	assert.Error(t, err, "Expected no journal without changed repositories")
+
+	entry := JournalEntry{
+		Path:          "/work/api",
+		Branch:        "feature",
+		Head:          "1111111111111111111111111111111111111111",
+		Stash:         "2222222222222222222222222222222222222222",
+		Aborted:       OperationRebase,
+		UpdatedBranch: "main",
+		UpdatedFrom:   "3333333333333333333333333333333333333333",
+	}
+	started := time.Date(2024, 3, 2, 9, 30, 0, 0, time.UTC)
+	for _, runID := range []string{"20240301T093000-00000001", "20240302T093000-00000002"} {
+		journal = newRunJournal(Config{RunID: runID, Started: started})
+		assert.NoError(t, journal.record(entry))
+		assert.True(t, journal.written(), "Expected a journal for run %s", runID)
+	}
+
+	// Entries are written before the update, and replaced once the branch moved.
+	loaded, err := loadJournal(dir, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []JournalEntry{entry}, loaded.Repositories)
+	entry.UpdatedTo = "4444444444444444444444444444444444444444"
+	web := JournalEntry{Path: "/work/web", Head: entry.Head, UpdatedBranch: "main", UpdatedFrom: entry.Head}
+	assert.NoError(t, journal.record(web))
+	assert.NoError(t, journal.record(entry))
+
+	loaded, err = loadJournal(dir, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "20240302T093000-00000002", loaded.RunID, "Expected the latest run")
+	assert.True(t, started.Equal(loaded.Started), "Expected the start of the run, got %s", loaded.Started)
+	assert.Equal(t, []JournalEntry{entry, web}, loaded.Repositories)
+
+	loaded, err = loadJournal(dir, "20240301T093000-00000001")
+	assert.NoError(t, err)
+	assert.Equal(t, "20240301T093000-00000001", loaded.RunID)
+
+	_, err = loadJournal(dir, "unknown")
+	assert.Error(t, err, "Expected an error for an unknown run")
+
+	// Removing the last entry removes the journal.
+	journal = newRunJournal(Config{RunID: "20240303T093000-00000003"})
+	assert.NoError(t, journal.record(web))
+	assert.NoError(t, journal.remove(web.Path))
+	assert.False(t, journal.written())
+	_, err = loadJournal(dir, "20240303T093000-00000003")
+	assert.Error(t, err, "Expected the journal to be removed")
+
+	// Entries without the HEAD before the update cannot be undone.
+	entry.Head = ""
+	assert.NoError(t, newRunJournal(Config{RunID: "20240304T093000-00000004"}).record(entry))
+	_, err = loadJournal(dir, "20240304T093000-00000004")
+	assert.Error(t, err, "Expected an error for an entry without head")
+}
+
+func TestRemoteHost(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/user/repo.git":         "github.com",
+		"ssh://git@gitlab.internal:2222/team/repo": "gitlab.internal",
+		"git@github.com:user/repo.git":             "github.com",
+		"gitlab.internal:team/repo.git":            "gitlab.internal",
+		"file:///srv/git/repo.git":                 "local",
+		"/srv/git/repo.git":                        "local",
+		"../repo.git":                              "local",
+		"":                                         "local",
+	}
+	for remoteURL, expected := range tests {
+		assert.Equal(t, expected, remoteHost(remoteURL), "Unexpected host for %q", remoteURL)
+	}
+}
+
+func TestHostBreakers(t *testing.T) {
+	// Start from closed circuits, however often the test runs.
+	defer func(saved *hostBreakers) { breakers = saved }(breakers)
+	breakers = &hostBreakers{breakers: map[string]*gobreaker.CircuitBreaker{}}
+	retry := RetryConfig{Attempts: 1}
+
+	// fetch returns a fetch failing with stderr.
+	fetch := func(stderr string) func() (GitOutput, error) {
+		runner := newFakeRunner().on("fetch origin", gitFailure(128, stderr))
+		return func() (GitOutput, error) {
+			return runGit(context.Background(), runner, ".", "fetch", "origin")
+		}
+	}
+
+	// Permanent failures of single repositories never open the circuit of the host.
+	for i := 0; i < 10; i++ {
+		err := execCommandWithRetry(context.Background(), fetch("remote: Repository not found."), "permanent.test",
+			"https://permanent.test/acme/gone.git", retry)
+		assert.NotErrorIs(t, err, errCircuitOpen)
+	}
+	assert.Equal(t, gobreaker.StateClosed, breakers.get("permanent.test").State())
+
+	// Neither does an interrupted run.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 10; i++ {
+		err := execCommandWithRetry(ctx, fetch("fatal: the remote end hung up unexpectedly"), "interrupted.test",
+			"https://interrupted.test/acme/api.git", retry)
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+	assert.Equal(t, gobreaker.StateClosed, breakers.get("interrupted.test").State())
+
+	// Transient failures open the circuit.
+	for i := 0; i < 4; i++ {
+		err := execCommandWithRetry(context.Background(), fetch("fatal: Could not resolve host: transient.test"),
+			"transient.test", "https://transient.test/acme/api.git", retry)
+		assert.NotErrorIs(t, err, errCircuitOpen)
+	}
+	err := execCommandWithRetry(context.Background(), fetch(""), "transient.test",
+		"https://transient.test/acme/api.git", retry)
+	assert.ErrorIs(t, err, errCircuitOpen)
+}
+
+func TestSummarizeHosts(t *testing.T) {
+	open := &RemoteError{Host: "gitlab.internal", Err: fmt.Errorf("%w for host gitlab.internal", errCircuitOpen)}
+	results := []CheckResult{
+		{RepoName: "api", Err: fmt.Errorf("Error fetching api. %w", &RemoteError{Host: "gitlab.internal",
+			Err: errors.New("connection refused")})},
+		{RepoName: "web", Err: fmt.Errorf("Error fetching web. %w", open)},
+		{RepoName: "cli", Err: fmt.Errorf("Error fetching cli. %w", open)},
+		{RepoName: "docs", Err: fmt.Errorf("Error fetching docs. %w", &RemoteError{Host: "github.com",
+			Err: errors.New("timeout")})},
+		{RepoName: "tools", Err: errors.New("tools has merge conflicts in file(s)")},
+		{RepoName: "infra"},
+	}
+
+	assert.Equal(t, []HostSummary{
+		{Host: "github.com", Failed: 1},
+		{Host: "gitlab.internal", Failed: 1, CircuitOpen: 2},
+	}, summarizeHosts(results))
+	assert.Empty(t, summarizeHosts(results[4:]), "Expected no unreachable hosts")
+}
+
+func TestLoadRetry(t *testing.T) {
+	// Define a temporary directory for the config file.
+	tempDir := filepath.Join("..", "test_retry")
+	err := os.MkdirAll(tempDir, 0755)
+	assert.NoError(t, err, "Failed to create temp dir for test config")
+	defer os.RemoveAll(tempDir)
+
+	configPath := filepath.Join(tempDir, ".rprc")
+	err = os.WriteFile(configPath, []byte("retry:\n  attempts: 3\n  base_delay: 250ms\n  max_delay: 2s\n"), 0644)
+	assert.NoError(t, err, "Failed to write test config file")
+
+	config, err := loadConfig(configPath)
+	assert.NoError(t, err, "Expected no error when loading config")
+	assert.Equal(t, RetryConfig{Attempts: 3, BaseDelay: 250 * time.Millisecond, MaxDelay: 2 * time.Second}, config.Retry)
+
+	// Delays double after every attempt up to the max delay.
+	assert.Equal(t, 250*time.Millisecond, config.Retry.backoff(1))
+	assert.Equal(t, time.Second, config.Retry.backoff(3))
+	assert.Equal(t, 2*time.Second, config.Retry.backoff(4))
+	assert.Equal(t, 2*time.Second, config.Retry.backoff(10))
+
+	for _, content := range []string{
+		"retry:\n  attempt: 3\n",
+		"retry:\n  attempts: -1\n",
+		"retry:\n  base_delay: 5s\n  max_delay: 1s\n",
+	} {
+		err = os.WriteFile(configPath, []byte(content), 0644)
+		assert.NoError(t, err, "Failed to write test config file")
+		_, err = loadConfig(configPath)
+		assert.Error(t, err, "Expected error for retry config %q", content)
+	}
+}
+
+func TestClassifyGitError(t *testing.T) {
+	tests := map[string]errorClass{
+		"": classTransient,
+		"fatal: unable to access 'https://github.com/acme/api.git/': Could not resolve host: github.com": classTransient,
+		"ssh: connect to host gitlab.internal port 22: Connection timed out":                             classTransient,
+		"error: RPC failed; HTTP 502 curl 22 The requested URL returned error: 502":                      classTransient,
+		"fatal: the remote end hung up unexpectedly":                                                     classTransient,
+		"remote: Invalid username or password.\nfatal: Authentication failed for 'https://github.com/'":  classPermanent,
+		"git@github.com: Permission denied (publickey).":                                                 classPermanent,
+		"remote: Repository not found.\nfatal: repository 'https://github.com/acme/gone.git/' not found": classPermanent,
+		"fatal: couldn't find remote ref refs/heads/missing":                                             classPermanent,
+		"fatal: The requested URL returned error: 403":                                                   classPermanent,
+		"fatal: unable to access 'https://github.com/acme/api.git/': Received HTTP code 407 from proxy":  classTransient,
+		"ssh: connect to host gitlab.internal port 22: Network is unreachable":                           classTransient,
+		"fatal: something unexpected":                                                                    classTransient,
+	}
+	for stderr, expected := range tests {
+		assert.Equal(t, expected, classifyGitError(stderr), "Unexpected class for %q", stderr)
+	}
+}
+
+func TestExecCommandWithRetry(t *testing.T) {
+	// Start from closed circuits, however often the test runs.
+	defer func(saved *hostBreakers) { breakers = saved }(breakers)
+	breakers = &hostBreakers{breakers: map[string]*gobreaker.CircuitBreaker{}}
+	retry := RetryConfig{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	// fetches returns a fetch answered by the outputs in turn, counting the commands run.
+	fetches := func(outputs ...GitOutput) (*fakeRunner, func() (GitOutput, error)) {
+		runner := newFakeRunner().on("fetch origin", outputs...)
+		return runner, func() (GitOutput, error) {
+			return runGit(context.Background(), runner, ".", "fetch", "origin")
+		}
+	}
+
+	// Every attempt runs a new command, so transient failures are retried until one succeeds.
+	runner, fetch := fetches(
+		gitFailure(128, "fatal: unable to access: Could not resolve host: example.com"),
+		gitFailure(128, "fatal: the remote end hung up unexpectedly"),
+		gitOutput(""),
+	)
+	err := execCommandWithRetry(context.Background(), fetch, "retry.test", "https://example.com/acme/api.git", retry)
+	assert.NoError(t, err)
+	assert.Len(t, runner.calls, 3, "Expected a success on the third attempt")
+
+	// The error includes the stderr of the last attempt.
+	runner, fetch = fetches(
+		gitFailure(128, "fatal: Could not resolve host: example.com (1)"),
+		gitFailure(128, "fatal: Could not resolve host: example.com (2)"),
+		gitFailure(128, "fatal: Could not resolve host: example.com (3)"),
+	)
+	err = execCommandWithRetry(context.Background(), fetch, "retry-exhausted.test",
+		"https://example.com/acme/api.git", retry)
+	assert.EqualError(t, err, "fatal: Could not resolve host: example.com (3) (failed after 3 attempts)")
+	assert.Len(t, runner.calls, 3, "Expected every attempt to be used")
+
+	// Permanent failures are not retried.
+	runner, fetch = fetches(gitFailure(128, "remote: Repository not found."))
+	err = execCommandWithRetry(context.Background(), fetch, "retry-permanent.test",
+		"https://example.com/acme/gone.git", retry)
+	assert.EqualError(t, err, "The remote repository acme/gone may not exist or was deleted.\n"+
+		"remote: Repository not found. (failed after 1 attempt)")
+	assert.Len(t, runner.calls, 1, "Expected a single attempt")
+}
+
+func TestIncompleteRun(t *testing.T) {
+	assert.NoError(t, incompleteRun(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.EqualError(t, incompleteRun(ctx), "run interrupted, repositories were skipped or rolled back")
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	assert.EqualError(t, incompleteRun(ctx), "run timed out, repositories were skipped or rolled back")
+}
+
+func TestManifestRepositories(t *testing.T) {
+	tempDir := filepath.Join("..", "test_manifest_repositories")
+	defer os.RemoveAll(tempDir)
+	cleanup := setupTestRepo(t, filepath.Join(tempDir, "deep", "down", "below", "api"))
+	defer cleanup()
+	cleanup = setupTestRepo(t, filepath.Join(tempDir, "worker"))
+	defer cleanup()
+
+	// Repositories deeper than max_depth are included, missing and excluded ones are not.
+	cfg := Config{
+		Root:      filepath.Join(tempDir, "elsewhere"),
+		ConfigDir: tempDir,
+		MaxDepth:  1,
+		Exclude:   []string{"worker"},
+		Manifest: []ManifestEntry{
+			{Path: "deep/down/below/api"},
+			{Path: "worker"},
+			{Path: "missing"},
+		},
+	}
+	assert.Equal(t, []string{filepath.Join(tempDir, "deep", "down", "below", "api")}, manifestRepositories(cfg))
+}
+
+func TestGitError(t *testing.T) {
+	runner := newFakeRunner().
+		on("pull --ff-only origin main", gitFailure(128, "hint: Diverging branches can't be fast-forwarded\n"+
+			"hint: Disable this message with \"git config advice.diverging false\"\n"+
+			"fatal: Not possible to fast-forward, aborting.\n")).
+		on("pull --rebase origin main", gitFailure(1, "Rebasing (1/1)\rerror: could not apply 1234567... Fix api\n"+
+			"hint: Resolve all conflicts manually\n")).
+		on("pull --no-rebase --ff origin main", GitOutput{
+			Stdout:   "Auto-merging api.go\nCONFLICT (content): Merge conflict in api.go\n",
+			Stderr:   " * branch            main       -> FETCH_HEAD\n",
+			ExitCode: 1,
+		}).
+		on("stash apply 1234567", GitOutput{Stdout: "On branch main\nnothing to commit\n", ExitCode: 1})
+
+	// The message is the fatal or error line, and the full output is kept.
+	_, err := runGit(context.Background(), runner, ".", "pull", "--ff-only", "origin", "main")
+	var gitErr *GitError
+	assert.True(t, errors.As(fmt.Errorf("Error pulling: %w", err), &gitErr), "Expected a GitError")
+	assert.EqualError(t, err, "fatal: Not possible to fast-forward, aborting.")
+	assert.Equal(t, "git pull --ff-only origin main", gitErr.Command())
+	assert.Equal(t, 128, gitErr.ExitCode)
+	assert.Contains(t, gitErr.Stderr, "Diverging branches")
+
+	// Progress updates overwritten with a carriage return are separate lines.
+	_, err = runGit(context.Background(), runner, ".", "pull", "--rebase", "origin", "main")
+	assert.EqualError(t, err, "error: could not apply 1234567... Fix api")
+
+	// Conflicts printed to stdout are preferred over other lines of stderr.
+	_, err = runGit(context.Background(), runner, ".", "pull", "--no-rebase", "--ff", "origin", "main")
+	assert.EqualError(t, err, "CONFLICT (content): Merge conflict in api.go")
+
+	// The full output is only shown in verbose mode.
+	assert.Empty(t, gitErrorDetails(err, Config{}))
+	assert.Equal(t, "\n  git pull --no-rebase --ff origin main (exit status 1)\n"+
+		"     * branch            main       -> FETCH_HEAD\n"+
+		"    Auto-merging api.go\n    CONFLICT (content): Merge conflict in api.go",
+		gitErrorDetails(err, Config{Verbose: true}))
+
+	// Without any fatal, error or conflict line the last line of stdout is used.
+	_, err = runGit(context.Background(), runner, ".", "stash", "apply", "1234567")
+	assert.EqualError(t, err, "nothing to commit")
+	assert.Empty(t, gitErrorDetails(errors.New("not a git error"), Config{Verbose: true}))
+
+	// Commands that print nothing report their exit status.
+	_, err = runGit(context.Background(), newFakeRunner().on("checkout main", gitFailure(1, "")), ".", "checkout",
+		"main")
+	assert.EqualError(t, err, "git checkout exited with status 1")
+
+	// The JSON report includes the failed command.
+	var buf bytes.Buffer
+	results := []CheckResult{{RepoName: "api", State: StateError, Err: fmt.Errorf("Error checking out: %w", err)}}
+	assert.NoError(t, renderJSON(&buf, results, Config{}))
+	assert.Contains(t, buf.String(), `"git_error": {
+        "command": "git checkout main",
+        "exit_code": 1,`)
+
+	// GitExecutor methods keep the GitError, so the details are reported for every failed command.
+	g := NewGitExecutor(Config{Branch: "main", RemoteName: "origin", Runner: newFakeRunner().
+		on("rev-list --left-right --count main...origin/main", gitFailure(128, "fatal: bad revision"))}, ".", "api")
+	_, _, err = g.commitsAheadBehind(context.Background())
+	assert.EqualError(t, err, "Error checking rev-list api: fatal: bad revision")
+	assert.Contains(t, gitErrorDetails(err, Config{Verbose: true}),
+		"git rev-list --left-right --count main...origin/main (exit status 128)")
+}
+
+func TestCheckIfBehind(t *testing.T) {
+	// The git dir holds the files that mark an operation in progress.
+	gitDir := filepath.Join("..", "test_fake_git")
+	err := os.MkdirAll(gitDir, 0o750)
+	assert.NoError(t, err)
+	defer os.RemoveAll(gitDir)
+	journals := filepath.Join("..", "test_check_journal")
+	defer os.RemoveAll(journals)
+
+	header := "# branch.oid 1111111111111111111111111111111111111111\x00# branch.head main\x00"
+	clean := header
+	dirty := header + "1 .M N... 100644 100644 100644 1111111 1111111 reporter.go\x00"
+	conflicted := header + "u UU N... 100644 100644 100644 100644 1111111 2222222 3333333 executor.go\x00"
+
+	tests := []struct {
+		name      string
+		status    string
+		operation string
+		force     bool
+		dryRun    bool
+		strategy  string
+		script    func(runner *fakeRunner)
+		interrupt string
+		// interruptAfter is a command that completes right before the run is interrupted.
+		interruptAfter string
+		noJournal      bool
+		// updateByRepo only enables the update in the overrides of the repository.
+		updateByRepo bool
+		state        RepoState
+		updated      bool
+		err          string
+		actions      []string
+		ran          []string
+		notRan       []string
+	}{
+		{
+			name:   "up to date",
+			status: clean,
+			script: func(runner *fakeRunner) {
+				runner.on("rev-list --left-right --count main...origin/main", gitOutput("0\t0\n"))
+			},
+			state:  StateUpToDate,
+			notRan: []string{"log", "pull"},
+		},
+		{
+			name:   "missing remote",
+			status: clean,
+			script: func(runner *fakeRunner) {
+				runner.on("remote get-url origin", gitFailure(2, "error: No such remote 'origin'"))
+			},
+			state:  StateSkipped,
+			err:    "No remote named 'origin' found for api",
+			notRan: []string{"fetch"},
+		},
+		{
+			name:   "fetch failure",
+			status: clean,
+			script: func(runner *fakeRunner) {
+				runner.on("fetch origin", gitFailure(128, "remote: Internal error\nfatal: unable to access "+
+					"'https://example.com/acme/api.git/': The requested URL returned error: 403"))
+			},
+			state: StateError,
+			err: "Error fetching api. fatal: unable to access 'https://example.com/acme/api.git/': " +
+				"The requested URL returned error: 403 (failed after 1 attempt)",
+			notRan: []string{"rev-list", "pull"},
+		},
+		{
+			name:    "behind and clean",
+			status:  clean,
+			state:   StateBehind,
+			updated: true,
+			actions: []string{"Pulling latest changes (ff-only)"},
+			ran:     []string{"pull --ff-only origin main"},
+			notRan:  []string{"stash"},
+		},
+		{
+			name:   "diverged cannot be fast-forwarded",
+			status: dirty,
+			script: func(runner *fakeRunner) {
+				runner.on("rev-list --left-right --count main...origin/main", gitOutput("1\t1\n"))
+			},
+			state: StateError,
+			err: "api has diverged from origin/main and cannot be fast-forwarded.\n" +
+				"To update anyway use --strategy rebase or --strategy merge.",
+			notRan: []string{"stash", "pull"},
+		},
+		{
+			name:    "local changes are stashed and reapplied",
+			status:  dirty,
+			state:   StateBehind,
+			updated: true,
+			actions: []string{"Stashing local changes", "Pulling latest changes (ff-only)", "Applying stashed changes"},
+			ran: []string{"stash push -m Stashed by reporter run run-1", "stash apply 5a5a5a5",
+				"stash drop -q stash@{0}"},
+		},
+		{
+			name:     "diverged merges regardless of pull.ff",
+			status:   clean,
+			strategy: StrategyMerge,
+			script: func(runner *fakeRunner) {
+				runner.on("rev-list --left-right --count main...origin/main", gitOutput("1\t1\n"))
+			},
+			state:   StateDiverged,
+			updated: true,
+			actions: []string{"Pulling latest changes (merge)"},
+			ran:     []string{"pull --no-rebase --ff origin main"},
+		},
+		{
+			name:      "operation in progress without force",
+			status:    dirty,
+			operation: "MERGE_HEAD",
+			state:     StateError,
+			err:       "api has a merge in progress.\nTo update anyway use --update --force. This aborts the merge.",
+			notRan:    []string{"merge --abort", "stash", "pull"},
+		},
+		{
+			name:      "operation in progress with force",
+			status:    clean,
+			operation: "MERGE_HEAD",
+			force:     true,
+			state:     StateBehind,
+			updated:   true,
+			actions:   []string{"Forcing update, aborting merge", "Pulling latest changes (ff-only)"},
+			ran:       []string{"merge --abort", "pull --ff-only origin main"},
+		},
+		{
+			name:      "dry run only reports the actions",
+			status:    dirty,
+			operation: "MERGE_HEAD",
+			force:     true,
+			dryRun:    true,
+			state:     StateBehind,
+			actions: []string{"Forcing update, aborting merge", "Stashing local changes",
+				"Pulling latest changes (ff-only, fast-forward)", "Applying stashed changes"},
+			notRan: []string{"merge --abort", "stash", "checkout", "pull"},
+		},
+		{
+			name:   "conflicts without an operation",
+			status: conflicted,
+			state:  StateError,
+			err:    "api has merge conflicts in file(s).\nResolve the conflicts first.",
+			notRan: []string{"stash", "pull"},
+		},
+		{
+			name:     "pull failure aborts the rebase and restores the stash",
+			status:   dirty,
+			strategy: StrategyRebase,
+			script: func(runner *fakeRunner) {
+				runner.on("pull --rebase origin main", gitFailure(1, "CONFLICT (content): Merge conflict"))
+			},
+			state: StateError,
+			err:   "Error pulling origin/main in repository api: CONFLICT (content): Merge conflict",
+			actions: []string{"Stashing local changes", "Pulling latest changes (rebase)", "Aborted rebase",
+				"Restored stashed changes"},
+			ran: []string{"rebase --abort", "stash apply 5a5a5a5"},
+		},
+		{
+			name:      "interrupted pull aborts the rebase and restores the stash",
+			status:    dirty,
+			strategy:  StrategyRebase,
+			interrupt: "pull --rebase origin main",
+			state:     StateError,
+			err:       "Error pulling origin/main in repository api: signal: killed (context canceled)",
+			actions: []string{"Stashing local changes", "Pulling latest changes (rebase)", "Aborted rebase",
+				"Restored stashed changes"},
+			ran: []string{"rebase --abort", "stash apply 5a5a5a5", "stash drop -q stash@{0}"},
+		},
+		{
+			name:           "interrupt after the pull still applies the stash",
+			status:         dirty,
+			interruptAfter: "pull --ff-only origin main",
+			state:          StateBehind,
+			updated:        true,
+			actions:        []string{"Stashing local changes", "Pulling latest changes (ff-only)", "Applying stashed changes"},
+			ran:            []string{"stash apply 5a5a5a5", "stash drop -q stash@{0}"},
+		},
+		{
+			name:   "unreadable branch after the pull is not journaled",
+			status: dirty,
+			script: func(runner *fakeRunner) {
+				runner.on("rev-parse --verify -q refs/heads/main^{commit}",
+					gitOutput("1111111111111111111111111111111111111111\n"), gitFailure(1, ""))
+			},
+			noJournal: true,
+			state:     StateError,
+			err: "Error reading branch main of api after the update, it cannot be undone: " +
+				"git rev-parse exited with status 1",
+			actions: []string{"Stashing local changes", "Pulling latest changes (ff-only)", "Restored stashed changes"},
+		},
+		{
+			name:         "update enabled for the repository is journaled",
+			status:       clean,
+			updateByRepo: true,
+			state:        StateBehind,
+			updated:      true,
+			actions:      []string{"Pulling latest changes (ff-only)"},
+		},
+		{
+			name:   "unreadable HEAD is not updated",
+			status: dirty,
+			script: func(runner *fakeRunner) {
+				runner.on("rev-parse --verify -q HEAD^{commit}", gitFailure(1, ""))
+			},
+			state:   StateError,
+			err:     "Error reading HEAD of api: git rev-parse exited with status 1",
+			actions: []string{"Stashing local changes", "Restored stashed changes"},
+			ran:     []string{"stash apply 5a5a5a5"},
+			notRan:  []string{"checkout", "pull"},
+		},
+		{
+			name:   "stash that no longer applies is kept",
+			status: dirty,
+			script: func(runner *fakeRunner) {
+				runner.on("stash apply "+strings.Repeat("5a", 20), gitFailure(1, "error: conflicts in reporter.go"))
+			},
+			state: StateError,
+			err: "Error applying stash 5a5a5a5: error: conflicts in reporter.go\n" +
+				"Changes remain stashed, restore them with: rp stash restore api",
+			actions: []string{"Stashing local changes", "Pulling latest changes (ff-only)", "Applying stashed changes"},
+			notRan:  []string{"stash drop"},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.operation != "" {
+				err := os.WriteFile(filepath.Join(gitDir, test.operation), nil, 0o600)
+				assert.NoError(t, err)
+				defer os.Remove(filepath.Join(gitDir, test.operation))
+			}
+			runner := scriptRepository("/work/api", gitDir, test.status)
+			if test.script != nil {
+				test.script(runner)
+			}
+			// The run is interrupted while the command runs, killing it.
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.interrupt != "" {
+				runner.onFunc(test.interrupt, func([]string) GitOutput {
+					cancel()
+					return GitOutput{ExitCode: -1}
+				})
+			}
+			if test.interruptAfter != "" {
+				runner.onFunc(test.interruptAfter, func([]string) GitOutput {
+					cancel()
+					return gitOutput("")
+				})
+			}
+			strategy := test.strategy
+			if strategy == "" {
+				strategy = StrategyFFOnly
+			}
+			cfg := Config{
+				Branch:     "main",
+				RemoteName: "origin",
+				Update:     !test.updateByRepo,
+				Force:      test.force,
+				DryRun:     test.dryRun,
+				Strategy:   strategy,
+				Jobs:       1,
+				RunID:      "run-1",
+				Retry:      RetryConfig{Attempts: 1},
+				Runner:     runner,
+			}
+			stateHome := filepath.Join(journals, strconv.Itoa(i))
+			t.Setenv("XDG_STATE_HOME", stateHome)
+			if test.updateByRepo {
+				update := true
+				cfg.Repos = map[string]RepoConfig{"api": {Update: &update}}
+			}
+			cfg.Journal = newRunJournal(cfg)
+
+			results := checkRepositories(ctx, []string{"/work/api"}, cfg)
+			assert.Len(t, results, 1)
+			result := results[0]
+			assert.Equal(t, test.state, result.State)
+			assert.Equal(t, test.updated, result.Updated)
+			if test.err == "" {
+				assert.NoError(t, result.Err)
+			} else {
+				assert.EqualError(t, result.Err, test.err)
+			}
+			assert.Equal(t, test.actions, result.Actions)
+			if test.noJournal {
+				assert.Nil(t, result.Journal, "Expected no journal entry")
+			}
+			// Every update is journaled on disk as it happens.
+			journal, jErr := loadJournal(filepath.Join(stateHome, "reporter", "runs"), cfg.RunID)
+			if result.Journal != nil {
+				assert.NoError(t, jErr)
+				assert.Equal(t, []JournalEntry{*result.Journal}, journal.Repositories)
+			} else {
+				assert.Error(t, jErr, "Expected no journal")
+			}
+			// Undo only resets branches that record the commit they were updated to.
+			if result.Updated && result.Journal != nil {
+				assert.NotEmpty(t, result.Journal.UpdatedTo, "Expected the updated commit to be journaled")
+			}
+			for _, command := range test.ran {
+				assert.True(t, runner.ran(command), "Expected git %s to run", command)
+			}
+			for _, command := range test.notRan {
+				assert.False(t, runner.ran(command), "Expected git %s not to run", command)
+			}
+			assert.Empty(t, runner.unscripted, "Expected only scripted commands to run")
+			// The url of the remote is read once, to check the remote and to tell its host.
+			getURL := 0
+			for _, command := range runner.calls {
+				if command == "remote get-url origin" {
+					getURL++
+				}
+			}
+			assert.LessOrEqual(t, getURL, 1, "Expected the url of the remote to be read once")
+		})
+	}
+}
+
+func TestCheckRepositoriesJobs(t *testing.T) {
+	const jobs = 3
+	gitDir := filepath.Join("..", "test_jobs_git")
+	err := os.MkdirAll(gitDir, 0o750)
+	assert.NoError(t, err)
+	defer os.RemoveAll(gitDir)
+
+	var (
+		mu                sync.Mutex
+		inFlight, maxSeen int
+		fullOnce          sync.Once
+	)
+	full := make(chan struct{})
+	release := make(chan struct{})
+	// Every fetch blocks until the pool is full, so the pool must run jobs fetches at once, and no more.
+	status := "# branch.oid 1111111111111111111111111111111111111111\x00# branch.head main\x00"
+	runner := scriptRepository("/work/api", gitDir, status).
+		onFunc("fetch origin", func([]string) GitOutput {
+			mu.Lock()
+			inFlight++
+			maxSeen = max(maxSeen, inFlight)
+			if inFlight == jobs {
+				fullOnce.Do(func() { close(full) })
+			}
+			mu.Unlock()
+			<-release
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return gitOutput("")
+		})
+	cfg := Config{
+		Branch:     "main",
+		RemoteName: "origin",
+		Strategy:   StrategyFFOnly,
+		Jobs:       jobs,
+		Retry:      RetryConfig{Attempts: 1},
+		Runner:     runner,
+	}
+	repos := make([]string, 8)
+	for i := range repos {
+		repos[i] = fmt.Sprintf("/work/repo-%d", i)
+	}
+
+	done := make(chan []CheckResult)
+	go func() {
+		done <- checkRepositories(context.Background(), repos, cfg)
+	}()
+	select {
+	case <-full:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected %d fetches to run at once", jobs)
+	}
+	// Give the other repositories time to start a fetch they must not run yet.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	results := <-done
+
+	assert.Equal(t, jobs, maxSeen, "Expected at most %d git commands at once", jobs)
+	assert.Len(t, results, len(repos), "Expected a result for every repository")
+	for _, result := range results {
+		assert.NoError(t, result.Err)
+		assert.Equal(t, StateBehind, result.State)
+	}
+	assert.Empty(t, runner.unscripted, "Expected only scripted commands to run")
 }
 
 func setupTestRepo(t *testing.T, dir string) func() {
@@ -223,3 +1387,141 @@ func setupTestRepo(t *testing.T, dir string) func() {
 		assert.NoError(t, err, "Failed to remove temp dir for test repo")
 	}
 }
+
+// fakeRunner is a GitRunner that answers git commands from a script instead of running git, and records the
+// commands run. Commands are matched by their arguments joined by spaces, or by a prefix ending in "*".
+type fakeRunner struct {
+	mu         sync.Mutex
+	script     map[string]func(args []string) GitOutput
+	calls      []string
+	unscripted []string
+}
+
+// newFakeRunner returns a fakeRunner without any scripted commands.
+func newFakeRunner() *fakeRunner {
+	return &fakeRunner{script: map[string]func(args []string) GitOutput{}}
+}
+
+// on scripts the outputs of a command, one for every call in turn. The last output repeats.
+func (f *fakeRunner) on(command string, outputs ...GitOutput) *fakeRunner {
+	var mu sync.Mutex
+	calls := 0
+	return f.onFunc(command, func([]string) GitOutput {
+		mu.Lock()
+		defer mu.Unlock()
+		output := outputs[min(calls, len(outputs)-1)]
+		calls++
+		return output
+	})
+}
+
+// onFunc scripts a command with a function of its arguments. The function runs outside the lock of the runner, so
+// it can block while other commands run.
+func (f *fakeRunner) onFunc(command string, fn func(args []string) GitOutput) *fakeRunner {
+	f.script[command] = fn
+	return f
+}
+
+// Run answers the command from the script. Unscripted commands fail, and like git commands, commands run once
+// ctx is done are killed before they start. A negative exit code stands for a killed command.
+func (f *fakeRunner) Run(ctx context.Context, _ string, args ...string) (GitOutput, error) {
+	command := strings.Join(args, " ")
+	if ctx.Err() != nil {
+		return GitOutput{ExitCode: -1}, ctx.Err()
+	}
+	fn, ok := f.lookup(command)
+	if !ok {
+		return gitFailure(128, "fatal: unscripted command: git "+command), errors.New("exit status 128")
+	}
+	output := fn(args)
+	if output.ExitCode < 0 {
+		return output, errors.New("signal: killed")
+	}
+	if output.ExitCode != 0 {
+		return output, fmt.Errorf("exit status %d", output.ExitCode)
+	}
+	return output, nil
+}
+
+// lookup records the command and returns its script.
+func (f *fakeRunner) lookup(command string) (func(args []string) GitOutput, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, command)
+
+	fn, ok := f.script[command]
+	for pattern, patternFn := range f.script {
+		if prefix, found := strings.CutSuffix(pattern, "*"); !ok && found && strings.HasPrefix(command, prefix) {
+			fn, ok = patternFn, true
+		}
+	}
+	if !ok {
+		f.unscripted = append(f.unscripted, command)
+	}
+	return fn, ok
+}
+
+// ran returns whether a command starting with prefix was run.
+func (f *fakeRunner) ran(prefix string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, command := range f.calls {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// gitOutput returns the output of a successful command.
+func gitOutput(stdout string) GitOutput {
+	return GitOutput{Stdout: stdout}
+}
+
+// gitFailure returns the output of a failed command.
+func gitFailure(exitCode int, stderr string) GitOutput {
+	return GitOutput{Stderr: stderr, ExitCode: exitCode}
+}
+
+// scriptRepository scripts the repository at root on branch main, one commit behind origin/main, with the
+// git dir and status output given. Stashes are kept in the stash list until they are dropped.
+func scriptRepository(root, gitDir, status string) *fakeRunner {
+	const (
+		before = "1111111111111111111111111111111111111111"
+		after  = "2222222222222222222222222222222222222222"
+		stash  = "5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a"
+	)
+	var stashList string
+	return newFakeRunner().
+		on("rev-parse --show-toplevel", gitOutput(root+"\n")).
+		on("status --porcelain=v2 --branch -z", gitOutput(status)).
+		on("remote get-url origin", gitOutput("https://example.com/acme/api.git\n")).
+		on("fetch origin", gitOutput("")).
+		on("rev-parse --verify main", gitOutput(before+"\n")).
+		on("rev-parse --verify origin/main", gitOutput(after+"\n")).
+		on("rev-list --left-right --count main...origin/main", gitOutput("0\t1\n")).
+		on("log -1 --pretty=format:%H%x1f%h%x1f%an%x1f%aI%x1f%s origin/main",
+			gitOutput(after+"\x1f2222222\x1fJane Doe\x1f2024-01-01T12:00:00+00:00\x1fFix the report")).
+		on("rev-parse --absolute-git-dir", gitOutput(gitDir+"\n")).
+		on("symbolic-ref --short -q HEAD", gitOutput("main\n")).
+		on("rev-parse --verify -q HEAD^{commit}", gitOutput(before+"\n")).
+		on("rev-parse --verify -q refs/heads/main^{commit}", gitOutput(before+"\n"), gitOutput(after+"\n")).
+		on("checkout main", gitOutput("")).
+		on("merge --abort", gitOutput("")).
+		on("rebase --abort", gitOutput("")).
+		on("pull --ff-only origin main", gitOutput("")).
+		on("pull --rebase origin main", gitOutput("")).
+		on("pull --no-rebase --ff origin main", gitOutput("")).
+		onFunc("stash push -m *", func(args []string) GitOutput {
+			stashList = stash + "\x1fOn main: " + args[3] + "\n"
+			return gitOutput("")
+		}).
+		onFunc("stash list --format=%H%x1f%gs", func([]string) GitOutput {
+			return gitOutput(stashList)
+		}).
+		on("stash apply "+stash, gitOutput("")).
+		onFunc("stash drop -q stash@{0}", func([]string) GitOutput {
+			stashList = ""
+			return gitOutput("")
+		})
+}
@@ -0,0 +1,81 @@
+package main
+
+// RepoState describes how a repository relates to its remote branch.
+type RepoState int
+
+// Repository states reported by checkIfBehind.
+const (
+	// StateUpToDate means the local branch matches the remote branch.
+	StateUpToDate RepoState = iota
+	// StateBehind means the remote branch has commits missing locally.
+	StateBehind
+	// StateAhead means the local branch has commits missing remotely.
+	StateAhead
+	// StateDiverged means both branches have commits missing from the other.
+	StateDiverged
+	// StateError means the repository could not be checked or updated.
+	StateError
+	// StateSkipped means the repository was not checked, e.g. the remote or branch is missing.
+	StateSkipped
+)
+
+// String returns the name of the state.
+func (s RepoState) String() string {
+	switch s {
+	case StateUpToDate:
+		return "up-to-date"
+	case StateBehind:
+		return "behind"
+	case StateAhead:
+		return "ahead"
+	case StateDiverged:
+		return "diverged"
+	case StateError:
+		return "error"
+	case StateSkipped:
+		return "skipped"
+	default:
+		return "unknown"
+	}
+}
+
+// Commit holds the details of a single commit. Date is the strict ISO 8601 author date.
+type Commit struct {
+	Hash      string `json:"hash"`
+	ShortHash string `json:"short_hash"`
+	Author    string `json:"author"`
+	Date      string `json:"date"`
+	Subject   string `json:"subject"`
+}
+
+// StatusCounts holds the number of changed files in a working tree.
+type StatusCounts struct {
+	Staged     int `json:"staged"`
+	Unstaged   int `json:"unstaged"`
+	Untracked  int `json:"untracked"`
+	Conflicted int `json:"conflicted"`
+}
+
+// IsDirty checks if the working tree has any changes.
+func (c StatusCounts) IsDirty() bool {
+	return c.Staged+c.Unstaged+c.Untracked+c.Conflicted > 0
+}
+
+// CheckResult holds the outcome of checking, and optionally updating, a single repository.
+type CheckResult struct {
+	RepoName   string
+	Path       string
+	Remote     string
+	RemoteURL  string
+	Branch     string
+	State      RepoState
+	Ahead      int
+	Behind     int
+	Status     StatusCounts
+	LastCommit *Commit
+	Actions    []string
+	DryRun     bool
+	Updated    bool
+	Journal    *JournalEntry
+	Err        error
+}
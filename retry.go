@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// errorClass tells whether a failed git command is worth retrying.
+type errorClass int
+
+const (
+	// classTransient is a failure that may go away, e.g. a network error, timeout or server error.
+	classTransient errorClass = iota
+	// classPermanent is a failure that fails the same way every time, e.g. bad credentials or a missing repository.
+	classPermanent
+)
+
+// permanentErrors are fragments of git stderr that no retry can fix.
+var permanentErrors = []string{
+	"authentication failed",
+	"permission denied",
+	"could not read username",
+	"could not read password",
+	"terminal prompts disabled",
+	"host key verification failed",
+	"repository not found",
+	"does not appear to be a git repository",
+	"couldn't find remote ref",
+	"no such remote",
+	"returned error: 401",
+	"returned error: 403",
+	"returned error: 404",
+}
+
+// classifyGitError classifies a failed git command by its stderr. Only failures known to be permanent are not
+// retried. Anything else, e.g. a network, proxy or ssh error in any of its many variants, or a command killed
+// by its timeout without any output, is transient and retried up to the configured number of attempts.
+func classifyGitError(stderr string) errorClass {
+	stderr = strings.ToLower(stderr)
+	for _, fragment := range permanentErrors {
+		if strings.Contains(stderr, fragment) {
+			return classPermanent
+		}
+	}
+	return classTransient
+}
+
+// backoff returns the delay before retrying after the given attempt, doubling the base delay after every
+// attempt up to the max delay.
+func (r RetryConfig) backoff(attempt int) time.Duration {
+	delay := r.BaseDelay
+	for i := 1; i < attempt && delay < r.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, r.MaxDelay)
+}
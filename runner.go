@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// GitRunner runs git commands. The repository is only ever changed through a runner, so the decisions made
+// on the output of git can be tested with a scripted runner instead of real repositories.
+type GitRunner interface {
+	// Run runs git with args in dir. A command that fails to start, is killed or exits with a non-zero exit
+	// code returns an error, alongside whatever output it produced.
+	Run(ctx context.Context, dir string, args ...string) (GitOutput, error)
+}
+
+// GitOutput is the output and exit code of a git command.
+type GitOutput struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// execRunner runs git as a child process, killed when ctx is done.
+type execRunner struct{}
+
+// Run runs git with args in dir.
+func (execRunner) Run(ctx context.Context, dir string, args ...string) (GitOutput, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := gitCommand(ctx, dir, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	output := GitOutput{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: -1}
+	if cmd.ProcessState != nil {
+		output.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	return output, err
+}
+
+// gitRunner returns the runner of the configuration, running git as a child process unless set.
+func (c Config) gitRunner() GitRunner {
+	if c.Runner != nil {
+		return c.Runner
+	}
+	return execRunner{}
+}
+
+// GitError is a git command that failed, with its exit code and output. Its message is the most relevant line
+// of the output, the full output is kept for verbose reports.
+type GitError struct {
+	Args     []string
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Err      error
+}
+
+// Error returns the trimmed git message, or how the command failed when git printed nothing.
+func (e *GitError) Error() string {
+	// A fatal, error or conflict line explains the failure best, wherever git printed it.
+	stderrLine, stderrLast := gitMessage(e.Stderr)
+	stdoutLine, stdoutLast := gitMessage(e.Stdout)
+	for _, message := range []string{stderrLine, stdoutLine, stderrLast, stdoutLast} {
+		if message != "" {
+			return message
+		}
+	}
+	if e.ExitCode > 0 {
+		return fmt.Sprintf("git %s exited with status %d", e.Args[0], e.ExitCode)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the error of running the command.
+func (e *GitError) Unwrap() error {
+	return e.Err
+}
+
+// Command returns the command line that failed.
+func (e *GitError) Command() string {
+	return "git " + strings.Join(e.Args, " ")
+}
+
+// Details returns the command line, exit code and full output of the failed command.
+func (e *GitError) Details() string {
+	details := fmt.Sprintf("%s (exit status %d)", e.Command(), e.ExitCode)
+	for _, output := range []string{e.Stderr, e.Stdout} {
+		output = strings.TrimRight(strings.ReplaceAll(output, "\r", "\n"), "\n")
+		if strings.TrimSpace(output) != "" {
+			details += "\n  " + strings.ReplaceAll(output, "\n", "\n  ")
+		}
+	}
+	return details
+}
+
+// gitMessage trims the output of git to its most relevant lines, the first fatal, error or conflict line, and
+// the last line that is not a hint. Progress updates overwritten with a carriage return count as lines.
+func gitMessage(output string) (important string, last string) {
+	for _, line := range strings.FieldsFunc(output, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "hint:"):
+		case strings.HasPrefix(line, "fatal:"), strings.HasPrefix(line, "error:"), strings.HasPrefix(line, "CONFLICT"):
+			if important == "" {
+				important = line
+			}
+		default:
+			last = line
+		}
+	}
+	return important, last
+}
+
+// runGit runs git with args in dir through the runner. Failures are returned as a *GitError.
+func runGit(ctx context.Context, runner GitRunner, dir string, args ...string) (GitOutput, error) {
+	output, err := runner.Run(ctx, dir, args...)
+	if err != nil {
+		return output, &GitError{
+			Args:     args,
+			ExitCode: output.ExitCode,
+			Stdout:   output.Stdout,
+			Stderr:   output.Stderr,
+			Err:      err,
+		}
+	}
+	return output, nil
+}
+
+// gitErrorDetails returns the full output of the git command that caused err, indented below the report of
+// the error, in verbose mode.
+func gitErrorDetails(err error, cfg Config) string {
+	var gitErr *GitError
+	if !cfg.Verbose || !errors.As(err, &gitErr) {
+		return ""
+	}
+	return "\n  " + strings.ReplaceAll(gitErr.Details(), "\n", "\n  ")
+}
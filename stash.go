@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// stashMessagePrefix starts the message of every stash made by reporter.
+const stashMessagePrefix = "Stashed by reporter"
+
+// newRunID returns a unique id for a run of reporter, starting with the time it started.
+func newRunID(now time.Time) string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return now.UTC().Format("20060102T150405.000000000")
+	}
+	return now.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// stashMessage returns the message of a stash made by the run with the given id at the given time.
+func stashMessage(runID string, at time.Time) string {
+	return fmt.Sprintf("%s run %s at %s", stashMessagePrefix, runID, at.UTC().Format(time.RFC3339))
+}
+
+// parseStashMessage parses the run id and time from the reflog subject of a stash, e.g.
+// "On main: Stashed by reporter run <id> at <time>". It returns false for stashes not made by reporter.
+func parseStashMessage(subject string) (runID string, at time.Time, ok bool) {
+	_, message, found := strings.Cut(subject, ": ")
+	if !found {
+		return "", time.Time{}, false
+	}
+	rest, found := strings.CutPrefix(message, stashMessagePrefix+" run ")
+	if !found {
+		return "", time.Time{}, false
+	}
+	runID, timestamp, found := strings.Cut(rest, " at ")
+	if !found {
+		return "", time.Time{}, false
+	}
+	at, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return runID, at, true
+}
+
+// ReporterStash is a stash made by reporter in one of the repositories.
+type ReporterStash struct {
+	RepoName string    `json:"name"`
+	Path     string    `json:"path"`
+	Branch   string    `json:"branch"`
+	Commit   string    `json:"commit"`
+	RunID    string    `json:"run_id"`
+	Created  time.Time `json:"created"`
+	Files    []string  `json:"files"`
+}
+
+// runStash lists, restores or drops the stashes made by reporter, as selected by args.
+func runStash(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(stashUsage)
+	}
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return errors.New(stashUsage)
+		}
+		stashes, err := findReporterStashes(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		if cfg.Output == OutputJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(stashes)
+		}
+		renderStashes(os.Stdout, stashes, cfg, time.Now())
+		return nil
+	case "restore", "drop":
+		if len(args) != 2 {
+			return errors.New(stashUsage)
+		}
+		return updateStashes(ctx, cfg, args[0], args[1])
+	}
+	return errors.New(stashUsage)
+}
+
+// stashUsage describes the arguments of the stash command.
+const stashUsage = "usage: rp stash list | rp stash restore <repo> | rp stash drop <repo>"
+
+// findReporterStashes returns the stashes made by reporter in the selected repositories, most recent first
+// within each repository.
+func findReporterStashes(ctx context.Context, cfg Config) ([]ReporterStash, error) {
+	repos, _, err := selectRepositories(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([][]ReporterStash, len(repos))
+	runConcurrently(len(repos), cfg.Jobs, func(i int) {
+		g := NewGitExecutor(cfg.forRepo(repos[i]), repos[i], filepath.Base(repos[i]))
+		entries, lErr := g.stashEntries(ctx)
+		if lErr != nil {
+			return
+		}
+		for _, entry := range entries {
+			runID, created, ok := parseStashMessage(entry.Subject)
+			if !ok {
+				continue
+			}
+			files, _ := g.stashFiles(ctx, entry.Commit)
+			found[i] = append(found[i], ReporterStash{
+				RepoName: g.RepoName,
+				Path:     repos[i],
+				Branch:   stashBranch(entry.Subject),
+				Commit:   entry.Commit,
+				RunID:    runID,
+				Created:  created,
+				Files:    files,
+			})
+		}
+	})
+
+	stashes := []ReporterStash{}
+	for _, repoStashes := range found {
+		stashes = append(stashes, repoStashes...)
+	}
+	return stashes, nil
+}
+
+// updateStashes restores or drops the most recent reporter stash of every repository matching the name, path,
+// glob or regular expression in pattern.
+func updateStashes(ctx context.Context, cfg Config, action, pattern string) error {
+	stashes, err := findReporterStashes(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	// Only the most recent stash of each repository is used, older ones are left for the next command.
+	used := map[string]bool{}
+	for _, stash := range stashes {
+		if used[stash.Path] || !matchesRepo(pattern, stash.RepoName, relativePath(cfg.Root, stash.Path)) {
+			continue
+		}
+		used[stash.Path] = true
+
+		g := NewGitExecutor(cfg.forRepo(stash.Path), stash.Path, stash.RepoName)
+		short := shortHash(stash.Commit)
+		switch {
+		case cfg.DryRun && action == "restore":
+			fmt.Printf("Would restore stash %s in %s\n", short, stash.RepoName)
+		case cfg.DryRun:
+			fmt.Printf("Would drop stash %s in %s\n", short, stash.RepoName)
+		case action == "restore":
+			if err = g.applyStash(ctx, stash.Commit); err != nil {
+				fmt.Printf("%sError restoring stash %s in %s, changes remain stashed: %v%s%s\n", LightRed, short,
+					stash.RepoName, err, gitErrorDetails(err, cfg), Reset)
+			} else {
+				fmt.Printf("%sRestored stash %s in %s%s\n", LightGreen, short, stash.RepoName, Reset)
+			}
+		default:
+			if err = g.dropStash(ctx, stash.Commit); err != nil {
+				fmt.Printf("%sError dropping stash %s in %s: %v%s%s\n", LightRed, short, stash.RepoName, err,
+					gitErrorDetails(err, cfg), Reset)
+			} else {
+				fmt.Printf("%sDropped stash %s in %s%s\n", LightGreen, short, stash.RepoName, Reset)
+			}
+		}
+	}
+	if len(used) == 0 {
+		return fmt.Errorf("no reporter stashes found for %s", pattern)
+	}
+	return nil
+}
+
+// renderStashes writes the stashes as a table with the repository, branch, age and number of files of each.
+func renderStashes(w io.Writer, stashes []ReporterStash, cfg Config, now time.Time) {
+	if len(stashes) == 0 {
+		fmt.Fprintln(w, "No reporter stashes found")
+		return
+	}
+	fmt.Fprintf(w, "\nReporter Stashes:\n\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REPOSITORY\tBRANCH\tAGE\tFILES\tSTASH")
+	for _, stash := range stashes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", relativePath(cfg.Root, stash.Path), stash.Branch,
+			formatAge(now.Sub(stash.Created)), len(stash.Files), shortHash(stash.Commit))
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
+
+// stashBranch returns the branch a stash was made on from its reflog subject, e.g. "On main: message".
+func stashBranch(subject string) string {
+	prefix, _, _ := strings.Cut(subject, ": ")
+	return strings.TrimPrefix(prefix, "On ")
+}
+
+// formatAge formats the time since something happened, e.g. "5m ago".
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(age.Hours()/24))
+}
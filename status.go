@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EntryKind identifies the type of a porcelain v2 status entry.
+type EntryKind int
+
+const (
+	// EntryOrdinary is a changed tracked file.
+	EntryOrdinary EntryKind = iota
+	// EntryRenamed is a renamed or copied tracked file.
+	EntryRenamed
+	// EntryUnmerged is a file with merge conflicts.
+	EntryUnmerged
+	// EntryUntracked is a file that is not tracked.
+	EntryUntracked
+	// EntryIgnored is a file that is ignored.
+	EntryIgnored
+)
+
+// StatusEntry describes a single file of the working tree. XY holds the index and working tree status codes,
+// where "." means unmodified.
+type StatusEntry struct {
+	Kind     EntryKind
+	XY       string
+	Path     string
+	OrigPath string
+}
+
+// BranchHeader holds the branch information reported by git status --branch.
+type BranchHeader struct {
+	OID      string
+	Head     string
+	Upstream string
+	Ahead    int
+	Behind   int
+}
+
+// GitStatus is the parsed output of git status --porcelain=v2 --branch -z.
+type GitStatus struct {
+	Branch  BranchHeader
+	Entries []StatusEntry
+}
+
+// parseStatus parses the NUL separated output of git status --porcelain=v2 --branch -z.
+func parseStatus(output string) (GitStatus, error) {
+	var status GitStatus
+	records := strings.Split(strings.TrimSuffix(output, "\x00"), "\x00")
+	for i := 0; i < len(records); i++ {
+		record := records[i]
+		if record == "" {
+			continue
+		}
+		kind, rest, _ := strings.Cut(record, " ")
+		switch kind {
+		case "#":
+			if err := status.Branch.parseHeader(rest); err != nil {
+				return status, err
+			}
+		case "1":
+			// 1 <XY> <sub> <mH> <mI> <mW> <hH> <hI> <path>
+			fields := strings.SplitN(rest, " ", 8)
+			if len(fields) != 8 {
+				return status, fmt.Errorf("malformed status entry %q", record)
+			}
+			status.Entries = append(status.Entries, StatusEntry{Kind: EntryOrdinary, XY: fields[0], Path: fields[7]})
+		case "2":
+			// 2 <XY> <sub> <mH> <mI> <mW> <hH> <hI> <X><score> <path>, followed by the original path.
+			fields := strings.SplitN(rest, " ", 9)
+			if len(fields) != 9 || i+1 >= len(records) {
+				return status, fmt.Errorf("malformed status entry %q", record)
+			}
+			i++
+			status.Entries = append(status.Entries, StatusEntry{
+				Kind:     EntryRenamed,
+				XY:       fields[0],
+				Path:     fields[8],
+				OrigPath: records[i],
+			})
+		case "u":
+			// u <XY> <sub> <m1> <m2> <m3> <mW> <h1> <h2> <h3> <path>
+			fields := strings.SplitN(rest, " ", 10)
+			if len(fields) != 10 {
+				return status, fmt.Errorf("malformed status entry %q", record)
+			}
+			status.Entries = append(status.Entries, StatusEntry{Kind: EntryUnmerged, XY: fields[0], Path: fields[9]})
+		case "?":
+			status.Entries = append(status.Entries, StatusEntry{Kind: EntryUntracked, XY: "??", Path: rest})
+		case "!":
+			status.Entries = append(status.Entries, StatusEntry{Kind: EntryIgnored, XY: "!!", Path: rest})
+		default:
+			return status, fmt.Errorf("unknown status entry %q", record)
+		}
+	}
+	return status, nil
+}
+
+// parseHeader parses a "# branch.<key> <value>" header line. Unknown headers are ignored.
+func (b *BranchHeader) parseHeader(header string) error {
+	key, value, _ := strings.Cut(header, " ")
+	switch key {
+	case "branch.oid":
+		b.OID = value
+	case "branch.head":
+		b.Head = value
+	case "branch.upstream":
+		b.Upstream = value
+	case "branch.ab":
+		ahead, behind, _ := strings.Cut(value, " ")
+		var err error
+		if b.Ahead, err = strconv.Atoi(strings.TrimPrefix(ahead, "+")); err != nil {
+			return fmt.Errorf("malformed branch header %q", header)
+		}
+		if b.Behind, err = strconv.Atoi(strings.TrimPrefix(behind, "-")); err != nil {
+			return fmt.Errorf("malformed branch header %q", header)
+		}
+	}
+	return nil
+}
+
+// counts returns the number of staged, unstaged, untracked and conflicted files.
+// A file with both staged and unstaged changes counts towards both.
+func (s GitStatus) counts() StatusCounts {
+	var counts StatusCounts
+	for _, entry := range s.Entries {
+		switch entry.Kind {
+		case EntryUntracked:
+			counts.Untracked++
+		case EntryUnmerged:
+			counts.Conflicted++
+		case EntryOrdinary, EntryRenamed:
+			if entry.XY[0] != '.' {
+				counts.Staged++
+			}
+			if entry.XY[1] != '.' {
+				counts.Unstaged++
+			}
+		case EntryIgnored:
+		}
+	}
+	return counts
+}
+
+// hasConflicts checks for unmerged files.
+func (s GitStatus) hasConflicts() bool {
+	for _, entry := range s.Entries {
+		if entry.Kind == EntryUnmerged {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// runSync clones the manifest repositories that are missing on disk, then checks every manifest repository as
+// usual.
+func runSync(ctx context.Context, cfg Config) error {
+	if len(cfg.Manifest) == 0 {
+		return errors.New("no manifest entries found in .rprc")
+	}
+
+	// Keep standard output a single JSON document.
+	var out io.Writer = os.Stdout
+	if cfg.Output == OutputJSON {
+		out = os.Stderr
+	}
+
+	var missing []ManifestEntry
+	for _, entry := range cfg.Manifest {
+		if !isRepositoryRoot(cfg.manifestPath(entry)) {
+			missing = append(missing, entry)
+		}
+	}
+
+	if len(missing) > 0 {
+		fmt.Fprintf(out, "\nCloning Missing Repositories:\n\n")
+		for i, err := range cloneRepositories(ctx, missing, cfg) {
+			entry := missing[i]
+			switch {
+			case err != nil:
+				fmt.Fprintf(out, "%s%v%s\n", LightRed, err, Reset)
+			case cfg.DryRun:
+				fmt.Fprintf(out, "Would clone %s into %s\n", entry.URL, entry.Path)
+			default:
+				fmt.Fprintf(out, "%sCloned %s into %s%s\n", LightGreen, entry.URL, entry.Path, Reset)
+			}
+		}
+	}
+
+	return reportRepositories(ctx, cfg, manifestRepositories(cfg), false)
+}
+
+// manifestRepositories returns the selected manifest repositories that exist on disk. Manifest paths are
+// resolved against the directory of .rprc, so they may be outside the current directory or deeper than
+// max_depth.
+func manifestRepositories(cfg Config) []string {
+	var repos []string
+	for _, entry := range cfg.Manifest {
+		dir := cfg.manifestPath(entry)
+		if isRepositoryRoot(dir) && cfg.isSelected(dir) {
+			repos = append(repos, dir)
+		}
+	}
+	return repos
+}
+
+// cloneRepositories clones the manifest entries with a bounded number of concurrent clones and returns the
+// error of each entry in order. Clones only stop when ctx is done, since large repositories can take longer
+// than the command timeout.
+func cloneRepositories(ctx context.Context, entries []ManifestEntry, cfg Config) []error {
+	errs := make([]error, len(entries))
+	if cfg.DryRun {
+		return errs
+	}
+	runConcurrently(len(entries), cfg.Jobs, func(i int) {
+		entry := entries[i]
+		if ctx.Err() != nil {
+			errs[i] = fmt.Errorf("Skipped cloning %s: %v", entry.Path, ctx.Err())
+			return
+		}
+		errs[i] = cloneRepository(ctx, entry.URL, cfg.manifestPath(entry), entry.Branch)
+	})
+	return errs
+}
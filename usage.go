@@ -6,17 +6,38 @@ import "fmt"
 func showUsage() {
 	header := "  %s\n  mvp-service is 13 commits behind\n  Last commit by Lois Lane Fri Nov 24 10:56:42 2023 +0100\n"
 	message := "  abc123 fix: provide db transaction context\n%s"
-	fmt.Println("Usage: rp (reporter) [OPTIONS]")
+	fmt.Println("Usage: rp (reporter) [COMMAND] [OPTIONS]")
 	fmt.Println()
 	fmt.Println("Reporter recursively reports and resolves drifts across multiple git repositories.")
 	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  sync              Clone repositories from the .rprc manifest that are missing, then check them")
+	fmt.Println("  freeze            Print a lock file recording the commit, branch and remote of every repository")
+	fmt.Println("  thaw <file>       Check out every repository at the commit recorded in a lock file")
+	fmt.Println("  stash list        List the stashes reporter left in every repository")
+	fmt.Println("  stash restore <r> Apply and drop the latest reporter stash of the matching repositories")
+	fmt.Println("  stash drop <r>    Drop the latest reporter stash of the matching repositories")
+	fmt.Println("  undo [run-id]     Restore the repositories changed by the latest or given update run")
+	fmt.Println()
 	fmt.Println("Options:")
 	fmt.Println("  --help, -h        Show this help message")
 	fmt.Println("  --update, -u      Automatically update repositories that are behind")
-	fmt.Println("  --branch, -b      Specify the branch to check (default: main)")
+	fmt.Println("  --branch, -b      Specify the branch to check, or auto for the remote default (default: main)")
 	fmt.Println("  --log, -l         Show the complete list of changes using git log")
-	fmt.Println("  --force, -f       Forcefully abort rebase and merge conflicts to update")
+	fmt.Println("  --force, -f       Abort a rebase, merge or other git operation in progress to update")
 	fmt.Println("  --remote, -r      Remote name (default: origin)")
+	fmt.Println("  --dry-run, -n     Show the actions an update would take without changing repositories")
+	fmt.Println("  --strategy, -s    Update strategy: ff-only, rebase or merge (default: ff-only)")
+	fmt.Println("  --stash-untracked Also stash untracked files before updating")
+	fmt.Println("  --jobs, -j        Number of repositories checked concurrently (default: CPU count, max 8)")
+	fmt.Println("  --timeout         Maximum duration of the whole run, e.g. 5m (default: none)")
+	fmt.Println("  --command-timeout Maximum duration of a single git command (default: 2m)")
+	fmt.Println("  --output, -o      Output format: text or json (default: text)")
+	fmt.Println("  --verbose, -v     Show the full output of failed git commands")
+	fmt.Println("  --group, -g       Only use repositories in the named group from .rprc")
+	fmt.Println("  --include         Include repositories matching a name, glob or re: regular expression")
+	fmt.Println("  --exclude         Exclude repositories matching a name, glob or re: regular expression")
+	fmt.Println("  --depth           Maximum directory depth searched for repositories (default: 3)")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println()
@@ -50,7 +71,7 @@ func showUsage() {
 	fmt.Printf(message, Reset)
 	fmt.Println("  :.")
 	fmt.Println("   Stashing local changes")
-	fmt.Println("   Pulling latest changes")
+	fmt.Println("   Pulling latest changes (ff-only)")
 	fmt.Println("   Applying stashed changes")
 	fmt.Printf("   %smvp-service is up-to-date%s\n", LightGreen, Reset)
 	fmt.Println()